@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bob620/baka-dns/cache"
+	"github.com/miekg/dns"
+)
+
+// Admin API, every request needs the token as a bearer token
+type AdminHandler struct {
+	token        string
+	localCache   *cache.Cache
+	messageCache *cache.MessageCache
+	invalidator  *Invalidator
+	mux          *http.ServeMux
+}
+
+type entryResponse struct {
+	Name    string    `json:"name"`
+	Class   string    `json:"class"`
+	DO      bool      `json:"do"`
+	CD      bool      `json:"cd"`
+	Subnet  string    `json:"subnet,omitempty"`
+	Types   []string  `json:"types"`
+	Records int       `json:"records"`
+	Expires time.Time `json:"expires"`
+}
+
+type listResponse struct {
+	Total   int             `json:"total"`
+	Offset  int             `json:"offset"`
+	Entries []entryResponse `json:"entries"`
+}
+
+type recordSetResponse struct {
+	Name     string    `json:"name"`
+	Class    string    `json:"class"`
+	DO       bool      `json:"do"`
+	CD       bool      `json:"cd"`
+	Subnet   string    `json:"subnet,omitempty"`
+	Type     string    `json:"type"`
+	Negative bool      `json:"negative"`
+	Rcode    string    `json:"rcode,omitempty"`
+	Hits     int64     `json:"hits"`
+	Expires  time.Time `json:"expires"`
+	// Records in zone file format with their remaining ttl
+	Records []string `json:"records"`
+}
+
+type flushRequest struct {
+	Scope string `json:"scope"`
+	Name  string `json:"name"`
+}
+
+type flushResponse struct {
+	Removed int    `json:"removed"`
+	Error   string `json:"error,omitempty"`
+}
+
+type seedRequest struct {
+	// Records in zone file format
+	Records []string `json:"records"`
+}
+
+func MakeAdminHandler(token string, localCache *cache.Cache, messageCache *cache.MessageCache, invalidator *Invalidator) *AdminHandler {
+	handler := &AdminHandler{token, localCache, messageCache, invalidator, http.NewServeMux()}
+
+	handler.mux.HandleFunc("/admin/cache", handler.list)
+	handler.mux.HandleFunc("/admin/cache/inspect", handler.inspect)
+	handler.mux.HandleFunc("/admin/cache/flush", handler.flush)
+	handler.mux.HandleFunc("/admin/cache/seed", handler.seed)
+
+	return handler
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(value)
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, map[string]string{"error": err.Error()})
+}
+
+// Only lets requests with the method through, answering the rest with 405
+func allowMethod(writer http.ResponseWriter, request *http.Request, method string) bool {
+	if request.Method != method {
+		writer.Header().Set("Allow", method)
+		writeError(writer, http.StatusMethodNotAllowed, fmt.Errorf("%s only", method))
+		return false
+	}
+
+	return true
+}
+
+func (handler *AdminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	header := request.Header.Get("Authorization")
+	given := strings.TrimPrefix(header, "Bearer ")
+	if given == header || subtle.ConstantTimeCompare([]byte(given), []byte(handler.token)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(writer, http.StatusUnauthorized, fmt.Errorf("bad token"))
+		return
+	}
+
+	handler.mux.ServeHTTP(writer, request)
+}
+
+func queryInt(request *http.Request, name string, fallback int) (int, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+
+	return number, nil
+}
+
+// GET /admin/cache?prefix=&offset=&limit=
+func (handler *AdminHandler) list(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodGet) {
+		return
+	}
+
+	offset, err := queryInt(request, "offset", 0)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(request, "limit", 100)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, total := handler.localCache.List(request.URL.Query().Get("prefix"), offset, limit)
+
+	response := listResponse{Total: total, Offset: offset, Entries: make([]entryResponse, len(entries))}
+	for i, entry := range entries {
+		types := make([]string, len(entry.Types))
+		for j, dnsType := range entry.Types {
+			types[j] = dnsType.String()
+		}
+
+		response.Entries[i] = entryResponse{
+			Name:    string(entry.Key.Name),
+			Class:   entry.Key.Class.String(),
+			DO:      entry.Key.DO,
+			CD:      entry.Key.CD,
+			Subnet:  entry.Key.Subnet,
+			Types:   types,
+			Records: entry.Records,
+			Expires: entry.Expires,
+		}
+	}
+
+	writeJSON(writer, http.StatusOK, response)
+}
+
+// GET /admin/cache/inspect?name=
+func (handler *AdminHandler) inspect(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodGet) {
+		return
+	}
+
+	name := request.URL.Query().Get("name")
+	if _, ok := dns.IsDomainName(name); !ok {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("%q is not a domain name", name))
+		return
+	}
+
+	infos := handler.localCache.Inspect(name)
+	response := make([]recordSetResponse, len(infos))
+	for i, info := range infos {
+		records := make([]string, len(info.Records))
+		for j, record := range info.Records {
+			records[j] = record.String()
+		}
+
+		// Nxdomain sets cover every type of the name
+		typeName := info.Type.String()
+		if info.Type == 0 {
+			typeName = "ANY"
+		}
+
+		response[i] = recordSetResponse{
+			Name:     string(info.Key.Name),
+			Class:    info.Key.Class.String(),
+			DO:       info.Key.DO,
+			CD:       info.Key.CD,
+			Subnet:   info.Key.Subnet,
+			Type:     typeName,
+			Negative: info.Negative,
+			Hits:     info.Hits,
+			Expires:  info.Expires,
+			Records:  records,
+		}
+		if info.Negative {
+			response[i].Rcode = dns.RcodeToString[info.Rcode]
+		}
+	}
+
+	writeJSON(writer, http.StatusOK, response)
+}
+
+// POST /admin/cache/flush {"scope": "name|suffix|all", "name": ""}
+func (handler *AdminHandler) flush(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	var flush flushRequest
+	if err := json.NewDecoder(request.Body).Decode(&flush); err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := checkFlush(flush.Scope, flush.Name); err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	removed, err := handler.invalidator.Flush(flush.Scope, flush.Name)
+
+	// The local flush went through even when redis couldn't be reached to pass it on
+	response := flushResponse{Removed: removed}
+	if err != nil {
+		response.Error = err.Error()
+		writeJSON(writer, http.StatusBadGateway, response)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, response)
+}
+
+// POST /admin/cache/seed {"records": ["example.com. 300 IN A 192.0.2.1"]}
+func (handler *AdminHandler) seed(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	var seed seedRequest
+	if err := json.NewDecoder(request.Body).Decode(&seed); err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	records := make([]dns.RR, len(seed.Records))
+	for i, text := range seed.Records {
+		record, err := dns.NewRR(text)
+		if err != nil || record == nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("record %d: %v", i, err))
+			return
+		}
+		records[i] = record
+	}
+
+	handler.localCache.Seed(records)
+	// Packed responses would keep answering with what the seeded records replaced
+	handler.messageCache.Clear()
+
+	writeJSON(writer, http.StatusOK, map[string]int{"seeded": len(records)})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Bob620/baka-dns/config"
+	"github.com/Bob620/baka-dns/upstream/pool"
+)
+
+// Upstream management, changes are written back to the config file when asked to with ?save=true
+type upstreamAdmin struct {
+	dnsPool    *pool.Pool
+	conf       *config.Config
+	configPath string
+	saveMutex  *sync.Mutex
+}
+
+type priorityRequest struct {
+	Priority uint `json:"priority"`
+}
+
+func (handler *AdminHandler) ManageUpstreams(dnsPool *pool.Pool, conf *config.Config, configPath string) {
+	admin := &upstreamAdmin{dnsPool, conf, configPath, &sync.Mutex{}}
+
+	handler.mux.HandleFunc("/admin/upstreams", admin.collection)
+	handler.mux.HandleFunc("/admin/upstreams/", admin.server)
+}
+
+func poolStatus(err error) int {
+	switch err {
+	case pool.ErrUnknownServer:
+		return http.StatusNotFound
+	case pool.ErrServerExists:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Save the pool's servers over the upstreams in the config file when the request asks for it
+func (admin *upstreamAdmin) save(request *http.Request) error {
+	if request.URL.Query().Get("save") != "true" {
+		return nil
+	}
+
+	admin.saveMutex.Lock()
+	defer admin.saveMutex.Unlock()
+
+	conf := *admin.conf
+	conf.Upstreams = admin.dnsPool.KnownServers()
+	return config.Save(admin.configPath, &conf)
+}
+
+// Answer a change with the servers as they now are
+func (admin *upstreamAdmin) changed(writer http.ResponseWriter, request *http.Request, err error) {
+	if err != nil {
+		writeError(writer, poolStatus(err), err)
+		return
+	}
+
+	if err := admin.save(request); err != nil {
+		writeError(writer, http.StatusInternalServerError, fmt.Errorf("changed but not saved: %v", err))
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, admin.dnsPool.Servers())
+}
+
+// GET /admin/upstreams lists servers, POST /admin/upstreams adds one
+func (admin *upstreamAdmin) collection(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		writeJSON(writer, http.StatusOK, admin.dnsPool.Servers())
+	case http.MethodPost:
+		var server pool.Server
+		if err := json.NewDecoder(request.Body).Decode(&server); err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		admin.changed(writer, request, admin.dnsPool.AddServer(server))
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writeError(writer, http.StatusMethodNotAllowed, fmt.Errorf("GET or POST only"))
+	}
+}
+
+// DELETE /admin/upstreams/<name> and POST /admin/upstreams/<name>/<drain|disable|enable|priority>
+func (admin *upstreamAdmin) server(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/admin/upstreams/"), "/", 2)
+	name := parts[0]
+
+	if len(parts) == 1 {
+		if !allowMethod(writer, request, http.MethodDelete) {
+			return
+		}
+
+		admin.changed(writer, request, admin.dnsPool.RemoveServer(name))
+		return
+	}
+
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	switch parts[1] {
+	case "drain":
+		admin.changed(writer, request, admin.dnsPool.DrainServer(name))
+	case "disable":
+		admin.changed(writer, request, admin.dnsPool.DisableServer(name))
+	case "enable":
+		admin.changed(writer, request, admin.dnsPool.EnableServer(name))
+	case "priority":
+		var priority priorityRequest
+		if err := json.NewDecoder(request.Body).Decode(&priority); err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+
+		admin.changed(writer, request, admin.dnsPool.SetPriority(name, priority.Priority))
+	default:
+		writeError(writer, http.StatusNotFound, fmt.Errorf("unknown action %q", parts[1]))
+	}
+}
@@ -0,0 +1,75 @@
+package authority
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Ttl of the records in empty zones, the same as the SOA minimum (RFC 6303 section 3)
+const emptyTtl = 10800
+
+// Reverse zones for private, loopback, link local and documentation addresses that should never be asked about on the
+// internet (RFC 6303 section 4)
+func EmptyZoneNames() []string {
+	names := []string{
+		"10.in-addr.arpa.",
+		"168.192.in-addr.arpa.",
+		"0.in-addr.arpa.",
+		"127.in-addr.arpa.",
+		"254.169.in-addr.arpa.",
+		"2.0.192.in-addr.arpa.",
+		"100.51.198.in-addr.arpa.",
+		"113.0.203.in-addr.arpa.",
+		"255.255.255.255.in-addr.arpa.",
+		strings.Repeat("0.", 32) + "ip6.arpa.",
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa.",
+		"d.f.ip6.arpa.",
+		"8.e.f.ip6.arpa.",
+		"9.e.f.ip6.arpa.",
+		"a.e.f.ip6.arpa.",
+		"b.e.f.ip6.arpa.",
+		"8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+
+	for i := 16; i <= 31; i++ {
+		names = append(names, strconv.Itoa(i)+".172.in-addr.arpa.")
+	}
+
+	return names
+}
+
+// Zone with nothing but the SOA and NS records every empty zone is served with, every name below it is NXDOMAIN
+func EmptyZone(origin string) *Zone {
+	origin = strings.ToLower(dns.Fqdn(origin))
+	zone := &Zone{Origin: origin, records: map[string][]dns.RR{}}
+
+	header := dns.RR_Header{Name: origin, Class: dns.ClassINET, Ttl: emptyTtl}
+
+	soa := &dns.SOA{Hdr: header, Ns: origin, Mbox: "nobody.invalid.", Serial: 1, Refresh: 604800, Retry: 86400, Expire: 2419200, Minttl: emptyTtl}
+	soa.Hdr.Rrtype = dns.TypeSOA
+	ns := &dns.NS{Hdr: header, Ns: origin}
+	ns.Hdr.Rrtype = dns.TypeNS
+
+	_ = zone.add(soa)
+	_ = zone.add(ns)
+	return zone
+}
+
+// Serve every empty zone that isn't excluded or already served from a file, returning how many are served
+func (zones *Zones) ServeEmpty(exclude []string) int {
+	excluded := map[string]bool{}
+	for _, name := range exclude {
+		excluded[strings.ToLower(dns.Fqdn(name))] = true
+	}
+
+	served := 0
+	for _, name := range EmptyZoneNames() {
+		if !excluded[name] && zones.Serve(EmptyZone(name)) {
+			served++
+		}
+	}
+
+	return served
+}
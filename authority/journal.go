@@ -0,0 +1,124 @@
+package authority
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Updates to a zone are journaled next to its master file
+func journalPath(path string) string {
+	return path + ".jnl"
+}
+
+// Journal line for an update record. Deleting an RRset or a name has no rdata to write, so those are written as the
+// name and type alone.
+func journalLine(record dns.RR) string {
+	header := record.Header()
+
+	switch header.Class {
+	case dns.ClassANY:
+		return fmt.Sprintf("delete %s %s", header.Name, dns.TypeToString[header.Rrtype])
+	case dns.ClassNONE:
+		deleted := dns.Copy(record)
+		deleted.Header().Class = dns.ClassINET
+		return "delete " + deleted.String()
+	default:
+		return "add " + record.String()
+	}
+}
+
+// Update record for a journal line
+func parseJournalLine(line string) (dns.RR, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("bad journal line %q", line)
+	}
+
+	rest := strings.TrimSpace(line[len(fields[0]):])
+
+	switch fields[0] {
+	case "add":
+		return dns.NewRR(rest)
+	case "delete":
+		if len(fields) == 3 {
+			rrtype, ok := dns.StringToType[fields[2]]
+			if !ok {
+				return nil, fmt.Errorf("bad journal line %q", line)
+			}
+			return &dns.ANY{Hdr: dns.RR_Header{Name: fields[1], Rrtype: rrtype, Class: dns.ClassANY}}, nil
+		}
+
+		record, err := dns.NewRR(rest)
+		if err == nil && record != nil {
+			record.Header().Class = dns.ClassNONE
+			record.Header().Ttl = 0
+		}
+		return record, err
+	}
+
+	return nil, fmt.Errorf("bad journal line %q", line)
+}
+
+// Append an update and the SOA it left the zone with, the journal is synced before the update is served
+func appendJournal(path, note string, updates []dns.RR, soa *dns.SOA) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	_, _ = fmt.Fprintf(writer, "; %s %s\n", time.Now().UTC().Format(time.RFC3339), note)
+	for _, record := range updates {
+		_, _ = fmt.Fprintln(writer, journalLine(record))
+	}
+	_, _ = fmt.Fprintln(writer, journalLine(soa))
+
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Apply the journaled updates to a zone just read from its master file, a zone without a journal is left as it is
+func (zone *Zone) replay(path string) (*Zone, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return zone, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == ';' {
+			continue
+		}
+
+		record, err := parseJournalLine(text)
+		if err != nil || record == nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+
+		if dns.IsSubDomain(zone.Origin, strings.ToLower(record.Header().Name)) {
+			zone.apply(record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return zone.rebuild(), nil
+}
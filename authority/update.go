@@ -0,0 +1,298 @@
+package authority
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// Types that only make sense in questions
+func isMeta(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+
+	return false
+}
+
+// Later than the other serial in sequence space arithmetic (RFC 1982)
+func serialNewer(serial, than uint32) bool {
+	return int32(serial-than) > 0
+}
+
+func (zone *Zone) rrset(name string, rrtype uint16) []dns.RR {
+	var set []dns.RR
+	for _, record := range zone.records[name] {
+		if record.Header().Rrtype == rrtype {
+			set = append(set, record)
+		}
+	}
+
+	return set
+}
+
+func contains(set []dns.RR, record dns.RR) bool {
+	for _, member := range set {
+		if dns.IsDuplicate(member, record) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check the prerequisites of an update (RFC 2136 section 3.2), returning the rcode the update fails with
+func (zone *Zone) checkPrereqs(prereqs []dns.RR) int {
+	values := map[rrsetKey][]dns.RR{}
+
+	for _, record := range prereqs {
+		header := record.Header()
+		name := strings.ToLower(header.Name)
+
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone.Origin, name) {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY && len(zone.records[name]) == 0 {
+				return dns.RcodeNameError
+			}
+			if header.Rrtype != dns.TypeANY && len(zone.rrset(name, header.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY && len(zone.records[name]) > 0 {
+				return dns.RcodeYXDomain
+			}
+			if header.Rrtype != dns.TypeANY && len(zone.rrset(name, header.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := rrsetKey{name, header.Rrtype}
+			values[key] = append(values[key], record)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites need the whole RRset to match
+	for key, want := range values {
+		have := zone.rrset(key.name, key.rrtype)
+		for _, record := range want {
+			if !contains(have, record) {
+				return dns.RcodeNXRrset
+			}
+		}
+		for _, record := range have {
+			if !contains(want, record) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// Check the update section before anything is changed (RFC 2136 section 3.4.1)
+func (zone *Zone) checkUpdates(updates []dns.RR) int {
+	for _, record := range updates {
+		header := record.Header()
+		if !dns.IsSubDomain(zone.Origin, strings.ToLower(header.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassINET:
+			if isMeta(header.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 || (isMeta(header.Rrtype) && header.Rrtype != dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || isMeta(header.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// Copy of the zone an update can change, record sets are replaced rather than changed in place
+func (zone *Zone) clone() *Zone {
+	records := make(map[string][]dns.RR, len(zone.records))
+	for owner, set := range zone.records {
+		records[owner] = set
+	}
+
+	return &Zone{Origin: zone.Origin, path: zone.path, soa: zone.soa, records: records}
+}
+
+// Zone with the same records, names that no longer have anything at or below them are dropped
+func (zone *Zone) rebuild() *Zone {
+	rebuilt := &Zone{Origin: zone.Origin, path: zone.path, records: map[string][]dns.RR{}}
+	for _, set := range zone.records {
+		for _, record := range set {
+			_ = rebuilt.add(record)
+		}
+	}
+
+	return rebuilt
+}
+
+// Apply one update record (RFC 2136 section 3.4.2), returning whether it changed anything. Class ANY deletes an RRset
+// or every RRset at the name, class NONE deletes a single record and anything else adds one. The SOA and NS records at
+// the origin are never deleted.
+func (zone *Zone) apply(record dns.RR) bool {
+	header := record.Header()
+	name := strings.ToLower(header.Name)
+	existing := zone.records[name]
+	kept := make([]dns.RR, len(existing))[:0]
+
+	switch header.Class {
+	case dns.ClassANY:
+		for _, current := range existing {
+			rrtype := current.Header().Rrtype
+			apex := name == zone.Origin && (rrtype == dns.TypeSOA || rrtype == dns.TypeNS)
+			if apex || (header.Rrtype != dns.TypeANY && rrtype != header.Rrtype) {
+				kept = append(kept, current)
+			}
+		}
+	case dns.ClassNONE:
+		target := dns.Copy(record)
+		target.Header().Class = dns.ClassINET
+		if header.Rrtype == dns.TypeSOA || (name == zone.Origin && header.Rrtype == dns.TypeNS && len(zone.rrset(name, dns.TypeNS)) < 2) {
+			return false
+		}
+
+		for _, current := range existing {
+			if !dns.IsDuplicate(current, target) {
+				kept = append(kept, current)
+			}
+		}
+	default:
+		return zone.addRecord(name, record)
+	}
+
+	if len(kept) == len(existing) {
+		return false
+	}
+
+	zone.records[name] = kept
+	return true
+}
+
+func (zone *Zone) addRecord(name string, record dns.RR) bool {
+	added := dns.Copy(record)
+	added.Header().Name = name
+	rrtype := added.Header().Rrtype
+	existing := zone.records[name]
+
+	if soa, ok := added.(*dns.SOA); ok {
+		if name != zone.Origin || !serialNewer(soa.Serial, zone.soa.Serial) {
+			return false
+		}
+		zone.soa = soa
+	}
+
+	kept := make([]dns.RR, len(existing))[:0]
+	for _, current := range existing {
+		currentType := current.Header().Rrtype
+
+		// A name with an alias can't have anything else, and the other way around
+		if (rrtype == dns.TypeCNAME) != (currentType == dns.TypeCNAME) {
+			return false
+		}
+
+		// Duplicates only update the ttl, and there is only one alias or SOA per name
+		if dns.IsDuplicate(current, added) || (currentType == rrtype && (rrtype == dns.TypeCNAME || rrtype == dns.TypeSOA)) {
+			if dns.IsDuplicate(current, added) && current.Header().Ttl == added.Header().Ttl {
+				return false
+			}
+			continue
+		}
+
+		kept = append(kept, current)
+	}
+
+	zone.records[name] = append(kept, added)
+	return true
+}
+
+// Apply an update (RFC 2136) to the zone with the origin, returning the rcode and the names the update changed. Changes
+// are journaled before they are served, and the SOA serial goes up with every update that changes something.
+func (zones *Zones) Update(origin string, prereqs, updates []dns.RR, note string) (int, []string) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	zones.updating.Lock()
+	defer zones.updating.Unlock()
+
+	zones.mutex.RLock()
+	zone := zones.zones[origin]
+	zones.mutex.RUnlock()
+
+	// Only zones read from a file have somewhere to keep their changes
+	if zone == nil || zone.path == "" {
+		return dns.RcodeNotAuth, nil
+	}
+
+	if rcode := zone.checkPrereqs(prereqs); rcode != dns.RcodeSuccess {
+		return rcode, nil
+	}
+	if rcode := zone.checkUpdates(updates); rcode != dns.RcodeSuccess {
+		return rcode, nil
+	}
+
+	updated := zone.clone()
+	var changed []string
+	seen := map[string]bool{}
+
+	for _, record := range updates {
+		if name := strings.ToLower(record.Header().Name); updated.apply(record) && !seen[name] {
+			seen[name] = true
+			changed = append(changed, name)
+		}
+	}
+
+	if len(changed) == 0 {
+		return dns.RcodeSuccess, nil
+	}
+
+	if updated.soa.Serial == zone.soa.Serial {
+		soa := dns.Copy(zone.soa).(*dns.SOA)
+		soa.Serial++
+		updated.addRecord(zone.Origin, soa)
+	}
+
+	if err := appendJournal(journalPath(zone.path), note, updates, updated.soa); err != nil {
+		fmt.Println("Unable to journal update, dropping it:", err)
+		return dns.RcodeServerFailure, nil
+	}
+
+	zones.mutex.Lock()
+	zones.zones[origin] = updated.rebuild()
+	zones.mutex.Unlock()
+
+	return dns.RcodeSuccess, changed
+}
@@ -0,0 +1,219 @@
+package authority
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Longest alias chain followed inside a zone
+const maxChain = 8
+
+// Zone is one zone served authoritatively, owner names are kept lower cased and fully qualified
+type Zone struct {
+	Origin string
+	// Master file the zone was read from, empty for zones that aren't read from a file
+	path string
+	soa  *dns.SOA
+	// Records by owner name, names that only exist because names below them do have no records
+	records map[string][]dns.RR
+}
+
+// Read a zone from a master file and replay the updates journaled for it, names in the file are relative to the origin
+func LoadZone(origin, path string) (*Zone, error) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zone := &Zone{Origin: origin, path: path, records: map[string][]dns.RR{}}
+
+	parser := dns.NewZoneParser(file, origin, path)
+	for record, ok := parser.Next(); ok; record, ok = parser.Next() {
+		if err := zone.add(record); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	if zone.soa == nil {
+		return nil, fmt.Errorf("%s: no SOA record for %s", path, origin)
+	}
+
+	return zone.replay(journalPath(path))
+}
+
+func (zone *Zone) add(record dns.RR) error {
+	owner := strings.ToLower(record.Header().Name)
+	if !dns.IsSubDomain(zone.Origin, owner) {
+		return fmt.Errorf("%s is outside of %s", owner, zone.Origin)
+	}
+
+	if soa, ok := record.(*dns.SOA); ok {
+		if owner != zone.Origin {
+			return fmt.Errorf("SOA record for %s is not at the origin", owner)
+		}
+		zone.soa = soa
+	}
+
+	if record.Header().Name != owner {
+		record.Header().Name = owner
+	}
+	zone.records[owner] = append(zone.records[owner], record)
+
+	// Every name between the record and the origin exists too
+	for offset, end := dns.NextLabel(owner, 0); !end; offset, end = dns.NextLabel(owner, offset) {
+		parent := owner[offset:]
+		if _, ok := zone.records[parent]; ok || !dns.IsSubDomain(zone.Origin, parent) {
+			break
+		}
+		zone.records[parent] = nil
+	}
+
+	return nil
+}
+
+func (zone *Zone) Soa() *dns.SOA {
+	return zone.soa
+}
+
+// SOA for the authority section of a negative answer, its ttl is the smaller of its own and its minimum (RFC 2308)
+func (zone *Zone) negativeSoa() dns.RR {
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return soa
+}
+
+// Highest delegation at or above the name, empty when the name is in the zone itself. The parent side of a cut is
+// authoritative for its DS records.
+func (zone *Zone) delegation(name string, qtype uint16) string {
+	cut := ""
+
+	for offset, end := 0, false; !end && name[offset:] != zone.Origin; offset, end = dns.NextLabel(name, offset) {
+		owner := name[offset:]
+		if owner == name && qtype == dns.TypeDS {
+			continue
+		}
+
+		for _, record := range zone.records[owner] {
+			if record.Header().Rrtype == dns.TypeNS {
+				cut = owner
+				break
+			}
+		}
+	}
+
+	return cut
+}
+
+// Records for the name, taken from the closest wildcard when the name doesn't exist (RFC 4592)
+func (zone *Zone) find(name string) ([]dns.RR, bool) {
+	if records, ok := zone.records[name]; ok {
+		return records, true
+	}
+
+	encloser := name
+	for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+		encloser = name[offset:]
+		if _, ok := zone.records[encloser]; ok {
+			break
+		}
+	}
+
+	wildcard, ok := zone.records["*."+encloser]
+	if !ok {
+		return nil, false
+	}
+
+	records := make([]dns.RR, len(wildcard))
+	for i, record := range wildcard {
+		records[i] = dns.Copy(record)
+		records[i].Header().Name = name
+	}
+
+	return records, true
+}
+
+// Referral to the name servers of a delegation, with glue for the name servers inside the zone
+func (zone *Zone) referral(res *dns.Msg, cut string) {
+	res.Authoritative = false
+
+	for _, record := range zone.records[cut] {
+		ns, ok := record.(*dns.NS)
+		if !ok {
+			continue
+		}
+		res.Ns = append(res.Ns, ns)
+
+		target := strings.ToLower(ns.Ns)
+		if !dns.IsSubDomain(zone.Origin, target) {
+			continue
+		}
+
+		for _, glue := range zone.records[target] {
+			if typ := glue.Header().Rrtype; typ == dns.TypeA || typ == dns.TypeAAAA {
+				res.Extra = append(res.Extra, glue)
+			}
+		}
+	}
+}
+
+// Answer a lower cased, fully qualified name in the zone. Aliases are followed while they stay inside the zone, an
+// answer ending in an alias out of the zone has nothing in its authority section.
+func (zone *Zone) Lookup(name string, qtype uint16) *dns.Msg {
+	res := &dns.Msg{}
+	res.Authoritative = true
+
+	for range [maxChain]struct{}{} {
+		if cut := zone.delegation(name, qtype); cut != "" {
+			// A chain into a delegation is left for the resolver to follow
+			if len(res.Answer) == 0 {
+				zone.referral(res, cut)
+			}
+			return res
+		}
+
+		records, ok := zone.find(name)
+		if !ok {
+			res.Rcode = dns.RcodeNameError
+			res.Ns = []dns.RR{zone.negativeSoa()}
+			return res
+		}
+
+		var answer []dns.RR
+		target := ""
+		for _, record := range records {
+			typ := record.Header().Rrtype
+			if typ == qtype || qtype == dns.TypeANY {
+				answer = append(answer, record)
+			} else if cname, ok := record.(*dns.CNAME); ok {
+				answer = []dns.RR{cname}
+				target = strings.ToLower(cname.Target)
+				break
+			}
+		}
+
+		if len(answer) == 0 {
+			res.Ns = []dns.RR{zone.negativeSoa()}
+			return res
+		}
+
+		res.Answer = append(res.Answer, answer...)
+		if target == "" || !dns.IsSubDomain(zone.Origin, target) {
+			return res
+		}
+		name = target
+	}
+
+	return res
+}
@@ -0,0 +1,139 @@
+package authority
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bob620/baka-dns/reload"
+	"github.com/miekg/dns"
+)
+
+type ZoneFile struct {
+	Origin string
+	Path   string
+}
+
+// Zones are the local zones, each one is read again on its own when its file changes
+type Zones struct {
+	files []ZoneFile
+	zones map[string]*Zone
+	mutex *sync.RWMutex
+	// Held while a zone is read or updated so updates aren't lost to a reload
+	updating *sync.Mutex
+	watcher  *reload.Watcher
+}
+
+func MakeZones(files []ZoneFile) (*Zones, error) {
+	zones := &Zones{files: files, zones: map[string]*Zone{}, mutex: &sync.RWMutex{}, updating: &sync.Mutex{}, watcher: reload.MakeWatcher()}
+
+	for _, file := range files {
+		if err := zones.load(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return zones, nil
+}
+
+func (zones *Zones) load(file ZoneFile) error {
+	zones.updating.Lock()
+	defer zones.updating.Unlock()
+
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+
+	zone, err := LoadZone(file.Origin, file.Path)
+
+	// A file that can't be read isn't tried again until it changes
+	zones.watcher.Read(file.Path, info.ModTime())
+	if err == nil {
+		zones.mutex.Lock()
+		zones.zones[zone.Origin] = zone
+		zones.mutex.Unlock()
+	}
+
+	return err
+}
+
+// Serve a zone that isn't read from a file, zones from files with the same origin take precedence
+func (zones *Zones) Serve(zone *Zone) bool {
+	zones.mutex.Lock()
+	defer zones.mutex.Unlock()
+
+	if _, ok := zones.zones[zone.Origin]; ok {
+		return false
+	}
+
+	zones.zones[zone.Origin] = zone
+	return true
+}
+
+// Called after every check that read a zone again
+func (zones *Zones) SetOnReload(onReload func()) {
+	zones.watcher.SetOnReload(onReload)
+}
+
+// Read the zones whose files changed since they were last read, a zone that fails to load keeps its old records
+func (zones *Zones) Check() {
+	reloaded := false
+
+	for _, file := range zones.files {
+		if !zones.watcher.Changed(file.Path) {
+			continue
+		}
+
+		if err := zones.load(file); err != nil {
+			fmt.Println("Unable to reload zone, keeping the old one:", err)
+			continue
+		}
+
+		fmt.Println("Reloaded zone", file.Origin)
+		reloaded = true
+	}
+
+	if reloaded {
+		zones.watcher.Reloaded()
+	}
+}
+
+func (zones *Zones) CheckEvery(interval time.Duration) {
+	reload.Every(interval, zones.Check)
+}
+
+func (zones *Zones) Count() int {
+	zones.mutex.RLock()
+	defer zones.mutex.RUnlock()
+
+	return len(zones.zones)
+}
+
+// Closest zone containing a lower cased, fully qualified name, nil when the name isn't in any local zone
+func (zones *Zones) Find(name string) *Zone {
+	zones.mutex.RLock()
+	defer zones.mutex.RUnlock()
+
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if zone := zones.zones[name[offset:]]; zone != nil {
+			return zone
+		}
+	}
+
+	return zones.zones["."]
+}
+
+// Authoritative answer for a name, nil when the name isn't in any local zone
+func (zones *Zones) Lookup(name string, qtype uint16) *dns.Msg {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	zone := zones.Find(name)
+	if zone == nil {
+		return nil
+	}
+
+	return zone.Lookup(name, qtype)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Ways blocked queries are answered
+const (
+	BlockNxdomain = "nxdomain"
+	// 0.0.0.0 for A and :: for AAAA queries, no records for anything else
+	BlockNull    = "null"
+	BlockRefused = "refused"
+)
+
+func checkBlockResponse(response string) error {
+	switch response {
+	case BlockNxdomain, BlockNull, BlockRefused:
+		return nil
+	}
+
+	return fmt.Errorf("blocklist response must be %s, %s or %s", BlockNxdomain, BlockNull, BlockRefused)
+}
+
+func blockedResponse(response string, question *dns.Question, ttl uint32) *dns.Msg {
+	res := new(dns.Msg)
+
+	switch response {
+	case BlockRefused:
+		res.Rcode = dns.RcodeRefused
+	case BlockNull:
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: ttl}
+		switch question.Qtype {
+		case dns.TypeA:
+			res.Answer = []dns.RR{&dns.A{Hdr: header, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			res.Answer = []dns.RR{&dns.AAAA{Hdr: header, AAAA: net.IPv6zero}}
+		}
+	default:
+		res.Rcode = dns.RcodeNameError
+	}
+
+	return res
+}
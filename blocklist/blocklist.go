@@ -0,0 +1,117 @@
+package blocklist
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Bob620/baka-dns/reload"
+)
+
+// Blocklist answers whether a name is blocked, names on the allowlist never are
+type Blocklist struct {
+	blockPaths []string
+	allowPaths []string
+	block      *trie
+	allow      *trie
+	mutex      *sync.RWMutex
+	blocked    int64
+	watcher    *reload.Watcher
+}
+
+func MakeBlocklist(blockPaths, allowPaths []string) (*Blocklist, error) {
+	blocklist := &Blocklist{
+		blockPaths: blockPaths,
+		allowPaths: allowPaths,
+		block:      makeTrie(),
+		allow:      makeTrie(),
+		mutex:      &sync.RWMutex{},
+		watcher:    reload.MakeWatcher(),
+	}
+
+	return blocklist, blocklist.Reload()
+}
+
+func loadFiles(paths []string, block, allow *trie) error {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		err = parse(file, block, allow)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Read every list again, the old lists stay in place unless all of them load
+func (blocklist *Blocklist) Reload() error {
+	block := makeTrie()
+	allow := makeTrie()
+
+	if err := loadFiles(blocklist.blockPaths, block, allow); err != nil {
+		return err
+	}
+	// Everything in an allowlist is allowed whatever syntax it is written in
+	if err := loadFiles(blocklist.allowPaths, allow, allow); err != nil {
+		return err
+	}
+
+	blocklist.mutex.Lock()
+	blocklist.block = block
+	blocklist.allow = allow
+	blocklist.mutex.Unlock()
+
+	blocklist.watcher.Reloaded()
+	return nil
+}
+
+// Called after every successful reload
+func (blocklist *Blocklist) SetOnReload(onReload func()) {
+	blocklist.watcher.SetOnReload(onReload)
+}
+
+func (blocklist *Blocklist) ReloadEvery(interval time.Duration) {
+	reload.Every(interval, func() {
+		if err := blocklist.Reload(); err != nil {
+			fmt.Println("Unable to reload blocklists, keeping the old ones:", err)
+			return
+		}
+
+		blocked, allowed := blocklist.Entries()
+		fmt.Printf("Reloaded blocklists with %d blocked and %d allowed entries\n", blocked, allowed)
+	})
+}
+
+// Whether a lower cased, fully qualified name is blocked
+func (blocklist *Blocklist) Blocked(name string) bool {
+	blocklist.mutex.RLock()
+	block := blocklist.block
+	allow := blocklist.allow
+	blocklist.mutex.RUnlock()
+
+	if allow.match(name) || !block.match(name) {
+		return false
+	}
+
+	atomic.AddInt64(&blocklist.blocked, 1)
+	return true
+}
+
+func (blocklist *Blocklist) Entries() (int, int) {
+	blocklist.mutex.RLock()
+	defer blocklist.mutex.RUnlock()
+
+	return blocklist.block.entries, blocklist.allow.entries
+}
+
+func (blocklist *Blocklist) GetBlocked() int64 {
+	return atomic.LoadInt64(&blocklist.blocked)
+}
@@ -0,0 +1,115 @@
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Names hosts files map to themselves, blocking them would break the host
+var hostsBoilerplate = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+func normalize(name string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return "", false
+	}
+
+	return name, true
+}
+
+// Adblock rules only block by domain when they are ||domain^ with no options besides $important, @@ rules are exceptions
+func parseAdblock(line string, block, allow *trie) {
+	target := block
+	if strings.HasPrefix(line, "@@") {
+		target = allow
+		line = line[2:]
+	}
+
+	if !strings.HasPrefix(line, "||") {
+		return
+	}
+	line = line[2:]
+
+	if options := strings.IndexByte(line, '$'); options >= 0 {
+		if line[options+1:] != "important" {
+			return
+		}
+		line = line[:options]
+	}
+
+	if !strings.HasSuffix(line, "^") {
+		return
+	}
+
+	if name, ok := normalize(strings.TrimSuffix(line, "^")); ok {
+		target.add(name, true, true)
+	}
+}
+
+// Read a list in hosts, plain domain or adblock syntax, the syntax is worked out line by line. Plain domains starting
+// with *. only match the names below them.
+func parse(reader io.Reader, block, allow *trie) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") {
+			parseAdblock(line, block, allow)
+			continue
+		}
+
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Hosts lines start with the address every name on them maps to
+		if net.ParseIP(fields[0]) != nil {
+			for _, field := range fields[1:] {
+				if name, ok := normalize(field); ok && !hostsBoilerplate[name] {
+					block.add(name, true, false)
+				}
+			}
+			continue
+		}
+
+		if len(fields) != 1 {
+			continue
+		}
+
+		if strings.HasPrefix(fields[0], "*.") {
+			if name, ok := normalize(fields[0][2:]); ok {
+				block.add(name, false, true)
+			}
+		} else if name, ok := normalize(fields[0]); ok {
+			block.add(name, true, false)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,77 @@
+package blocklist
+
+// Names are stored by label from the root down, so a name and everything below it share one path
+type node struct {
+	children map[string]*node
+	// Whether the name itself matches, and whether every name below it does
+	exact bool
+	below bool
+}
+
+type trie struct {
+	root    *node
+	entries int
+}
+
+func makeTrie() *trie {
+	return &trie{root: &node{}}
+}
+
+// Add a lower cased, fully qualified name, matching just the name, the names below it or both
+func (trie *trie) add(name string, exact, below bool) {
+	current := trie.root
+
+	end := len(name) - 1
+	for end > 0 {
+		start := end - 1
+		for start >= 0 && name[start] != '.' {
+			start--
+		}
+
+		label := name[start+1 : end]
+		if current.children == nil {
+			current.children = make(map[string]*node, 1)
+		}
+
+		child := current.children[label]
+		if child == nil {
+			child = &node{}
+			current.children[label] = child
+		}
+
+		current = child
+		end = start
+	}
+
+	if (exact && !current.exact) || (below && !current.below) {
+		trie.entries++
+	}
+	current.exact = current.exact || exact
+	current.below = current.below || below
+}
+
+// Whether a lower cased, fully qualified name or one of its parents matches, without allocating
+func (trie *trie) match(name string) bool {
+	current := trie.root
+
+	end := len(name) - 1
+	for end > 0 {
+		if current.below && current != trie.root {
+			return true
+		}
+
+		start := end - 1
+		for start >= 0 && name[start] != '.' {
+			start--
+		}
+
+		current = current.children[name[start+1:end]]
+		if current == nil {
+			return false
+		}
+
+		end = start
+	}
+
+	return current.exact
+}
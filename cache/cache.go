@@ -3,179 +3,250 @@ package cache
 import (
 	"github.com/Bob620/baka-dns/statistics"
 	"github.com/miekg/dns"
-	"sync"
 	"time"
 )
 
-type Cache struct {
-	expireOrder []dns.Name
-	domains     map[dns.Name]*Domain
-	size        int
-	mutex       *sync.RWMutex
-	statistics  *statistics.Cache
+// NXDOMAIN answers are kept under a type no record can have since they cover every type of the name
+const nxdomainType = dns.Type(0)
+
+// Answer is what the cache holds for a question, negative answers carry their SOA for the authority section
+type Answer struct {
+	Records []dns.RR
+	Ns      []dns.RR
+	Rcode   int
 }
 
-func MakeCache(size int) *Cache {
-	return &Cache{
-		expireOrder: make([]dns.Name, size)[:0],
-		domains:     make(map[dns.Name]*Domain, size),
-		size:        size,
-		mutex:       &sync.RWMutex{},
-		statistics:  statistics.MakeCache(int64(size)),
-	}
+// Cache splits domains across shards by name hash, each shard with its own lock and eviction
+type Cache struct {
+	shards           []*shard
+	statistics       *statistics.Cache
+	prefetchMinHits  int64
+	prefetchFraction float64
+	refresh          func(Key, dns.Type) []dns.RR
+	staleWindow      time.Duration
+	staleTtl         uint32
+	ttls             *TTLPolicy
 }
 
-func (cache *Cache) clean() {
-	now := time.Now()
+func MakeCache(size, shardCount int) *Cache {
+	if shardCount < 1 {
+		shardCount = 1
+	}
 
-	// Filter the cache
-	newPos := 0
+	cache := &Cache{
+		shards:     make([]*shard, shardCount),
+		statistics: statistics.MakeCache(int64(size)),
+	}
 
-	cache.mutex.Lock()
-	for _, domainName := range cache.expireOrder {
-		if domainName == "" {
-			continue
-		}
+	shardSize := (size + shardCount - 1) / shardCount
+	for i := range cache.shards {
+		cache.shards[i] = makeShard(shardSize, cache.statistics)
+	}
 
-		if cache.domains[domainName] == nil {
-			delete(cache.domains, domainName)
-			continue
-		}
+	return cache
+}
 
-		if !cache.domains[domainName].Expires.After(now) {
-			delete(cache.domains, domainName)
-		} else {
-			cache.expireOrder[newPos] = domainName
-			newPos++
-		}
+// FNV-1a hash of the name picks the shard and its slots in the frequency sketch
+func (cache *Cache) shard(key Key) (*shard, uint32) {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key.Name); i++ {
+		hash ^= uint32(key.Name[i])
+		hash *= 16777619
 	}
-	cache.expireOrder = cache.expireOrder[:newPos]
-	cache.statistics.SetSize(int64(len(cache.expireOrder)))
-	cache.mutex.Unlock()
+
+	return cache.shards[hash%uint32(len(cache.shards))], hash
 }
 
-func (cache *Cache) deleteFirst() {
-	var domainName dns.Name
-	cache.mutex.Lock()
-	domainName, cache.expireOrder = cache.expireOrder[0], cache.expireOrder[1:]
-	domain := cache.domains[domainName]
-	if domain != nil {
-		cache.statistics.Evict()
-	}
+// Refresh popular record sets in the background once they reach the last fraction of their ttl
+func (cache *Cache) SetPrefetch(minHits int64, fraction float64, refresh func(Key, dns.Type) []dns.RR) {
+	cache.prefetchMinHits = minHits
+	cache.prefetchFraction = fraction
+	cache.refresh = refresh
+}
 
-	delete(cache.domains, domainName)
-	cache.statistics.SetSize(int64(len(cache.expireOrder)))
-	cache.mutex.Unlock()
+// Keep expired records around for the window so they can be served with the given ttl when upstreams fail
+func (cache *Cache) SetStale(window time.Duration, ttl uint32) {
+	cache.staleWindow = window
+	cache.staleTtl = ttl
 }
 
-func (cache *Cache) getDomain(domainName dns.Name) *Domain {
-	now := time.Now()
+func (cache *Cache) SetTTLPolicy(policy *TTLPolicy) {
+	cache.ttls = policy
+}
 
-	cache.mutex.RLock()
-	domain := cache.domains[domainName]
-	cache.mutex.RUnlock()
+func (cache *Cache) TTLPolicy() *TTLPolicy {
+	return cache.ttls
+}
 
-	if domain != nil && domain.Expires.Before(now) {
-		cache.clean()
-		return nil
+// Replace the record set with a fresh one, a failed refresh leaves the set to be refreshed by a later hit
+func (cache *Cache) prefetch(key Key, recordType dns.Type, set *RecordSet) {
+	started := time.Now()
+	cache.statistics.Prefetch()
+
+	records := cache.refresh(key, recordType)
+	if len(records) > 0 {
+		cache.set(key, records, false, time.Since(started))
+	} else {
+		set.refreshFailed()
 	}
+}
 
-	return domain
+func (cache *Cache) Statistics() *statistics.Cache {
+	return cache.statistics
 }
 
-func (cache *Cache) setDomain(domainName dns.Name, domain *Domain) {
-	cache.mutex.Lock()
-	cache.expireOrder = append(cache.expireOrder, domainName)
-	cache.domains[domainName] = domain
-	cache.statistics.SetSize(int64(len(cache.expireOrder)))
-	cache.mutex.Unlock()
+func (cache *Cache) getDomain(key Key, now time.Time) *Domain {
+	shard, hash := cache.shard(key)
+	return shard.getDomain(key, hash, true, now)
 }
 
-func (cache *Cache) Get(domainName dns.Name, recordType dns.Type) ([]dns.RR, bool) {
-	var cnames *RecordSet
+func (cache *Cache) peekDomain(key Key, now time.Time) *Domain {
+	shard, hash := cache.shard(key)
+	return shard.getDomain(key, hash, false, now)
+}
+
+// Follow cnames and dnames through the cache, returns the answer found so far and the name whose records are still
+// missing, which is empty when the answer is complete
+func (cache *Cache) Get(key Key, recordType dns.Type) (*Answer, dns.Name) {
 	now := time.Now()
-	cnameType := dns.Type(dns.TypeCNAME)
-	output := make([]dns.RR, 2)[:0]
 
-	domain := cache.getDomain(domainName)
+	chain, final, records, finalKey, missing := cache.chase(key, recordType, func(set *RecordSet) []dns.RR {
+		if !set.Expires.After(now) {
+			return nil
+		}
+		return set.GetRecords(now)
+	}, true, now)
 
-	if domain == nil {
-		return nil, false
+	if records == nil {
+		cache.statistics.Miss()
+		if chain == nil {
+			return nil, missing
+		}
+		return &Answer{Records: chain}, missing
 	}
 
-	if recordType != cnameType {
-		cnames = domain.Get(cnameType)
+	if records.claimTangent() {
+		cache.statistics.TangentHit()
 	}
-	records := domain.Get(recordType)
 
-	if cnames != nil {
-		if cnames.Expires.Before(now) || cnames.Len() == 0 {
-			domain.delete(cnameType)
-			cnames = nil
-		} else {
-			cnames.clean()
-			output = append(output, cnames.GetRecords()...)
-		}
+	cache.statistics.Hit()
+	if records.negative {
+		return &Answer{Records: chain, Ns: final, Rcode: records.rcode}, ""
 	}
 
-	if records != nil {
-		if records.Expires.Before(now) || records.Len() == 0 {
-			domain.delete(recordType)
-			records = nil
-		} else {
-			records.clean()
-			output = append(output, records.GetRecords()...)
-		}
+	if saved := records.claimPrefetch(); saved > 0 {
+		cache.statistics.PrefetchHit(saved)
 	}
 
-	if records == nil && cnames == nil {
-		cache.statistics.Miss()
-		return nil, false
+	if cache.refresh != nil && records.wantsRefresh(now, cache.prefetchMinHits, cache.prefetchFraction) {
+		go cache.prefetch(finalKey, recordType, records)
 	}
 
-	cache.statistics.Hit()
-	return output, records == nil
+	// The final records are shared with other hits, only a chain in front of them needs a new slice
+	if len(chain) == 0 {
+		return &Answer{Records: final}, ""
+	}
+	return &Answer{Records: append(chain, final...)}, ""
 }
 
-func (cache *Cache) Set(domainName dns.Name, records []dns.RR, tangent bool) {
+// Name whose records are still missing for the key like Get, without counting as a lookup. Tangent and other
+// background queries use this so only clients decide which names are popular enough to keep.
+func (cache *Cache) Missing(key Key, recordType dns.Type) dns.Name {
 	now := time.Now()
 
-	domain := cache.getDomain(domainName)
-	if domain == nil {
-		cache.clean()
-		if len(cache.expireOrder)+len(records) >= cache.size {
-			for range records {
-				cache.deleteFirst()
-			}
+	_, _, _, _, missing := cache.chase(key, recordType, func(set *RecordSet) []dns.RR {
+		if !set.Expires.After(now) {
+			return nil
 		}
+		return set.GetRecords(now)
+	}, false, now)
+
+	return missing
+}
 
-		domain = createDomain()
+// Count a lookup answered from outside the cache, like a message cache hit, towards the popularity of the name
+func (cache *Cache) Touch(key Key) {
+	cache.getDomain(key, time.Now())
+}
+
+// Expired records still inside the stale window, along with the chain leading to them, all with the stale ttl
+func (cache *Cache) GetStale(key Key, recordType dns.Type) []dns.RR {
+	now := time.Now()
+	cutoff := now.Add(-cache.staleWindow)
+	if cache.staleWindow <= 0 {
+		return nil
 	}
 
-	cleanTypes := make(map[dns.Type]bool)
+	chain, final, records, _, _ := cache.chase(key, recordType, func(set *RecordSet) []dns.RR {
+		if set.negative || !set.Expires.After(cutoff) {
+			return nil
+		}
+		return set.GetStale(cache.staleTtl)
+	}, false, now)
+
+	if records == nil {
+		return nil
+	}
+
+	cache.statistics.Stale()
+	return append(chain, final...)
+}
+
+func (cache *Cache) Set(key Key, records []dns.RR, tangent bool) {
+	if tangent {
+		cache.statistics.TangentRequest()
+	} else {
+		cache.statistics.Request()
+	}
+
+	cache.set(key, records, tangent, 0)
+}
+
+// Replaces the record sets of the given types under each owner name on the alias chain from the key, the old sets keep
+// answering until the new ones are in place. Records for names off the chain are dropped.
+func (cache *Cache) set(key Key, records []dns.RR, tangent bool, prefetchSaved time.Duration) {
+	now := time.Now()
+	owners := make(map[Key]map[dns.Type]*RecordSet, 1)
+	chain := chainOwners(key, records)
 
 	for _, record := range records {
 		header := record.Header()
 		recordType := dns.Type(header.Rrtype)
-		ttl := now.Add(time.Second * time.Duration(header.Ttl))
+		owner := key.WithName(header.Name)
+		if !chain[owner.Name] {
+			continue
+		}
+
+		sets := owners[owner]
+		if sets == nil {
+			sets = make(map[dns.Type]*RecordSet, 2)
+			owners[owner] = sets
+		}
 
-		set := domain.Get(recordType)
-		if set == nil || cleanTypes[recordType] == false {
-			cleanTypes[recordType] = true
-			set = createRecordSet()
+		set := sets[recordType]
+		if set == nil {
+			set = createRecordSet(tangent, prefetchSaved)
+			sets[recordType] = set
 		}
 
 		set.Add(&Record{
 			RR:      record,
-			Expires: ttl,
+			Expires: now.Add(time.Second * time.Duration(cache.ttls.Clamp(header.Name, header.Ttl, false))),
 		})
+		cache.statistics.Insert()
+	}
 
-		if domain.Expires.Before(set.Expires) {
-			domain.Expires = set.Expires
-		}
+	for owner, sets := range owners {
+		shard, hash := cache.shard(owner)
+		shard.setDomain(owner, hash, sets, cache.staleWindow, false)
+	}
+}
 
-		domain.Set(recordType, set)
-		cache.statistics.Insert()
+// Cache a NXDOMAIN or NODATA answer for the key with the SOA from the authority section, which gives its ttl
+func (cache *Cache) SetNegative(key Key, recordType dns.Type, rcode int, ns []dns.RR, tangent bool) {
+	soa, ttl, ok := negativeTtl(ns)
+	if !ok {
+		return
 	}
 
 	if tangent {
@@ -184,5 +255,60 @@ func (cache *Cache) Set(domainName dns.Name, records []dns.RR, tangent bool) {
 		cache.statistics.Request()
 	}
 
-	cache.setDomain(domainName, domain)
+	if rcode == dns.RcodeNameError {
+		recordType = nxdomainType
+	}
+
+	set := createRecordSet(tangent, 0)
+	set.negative = true
+	set.rcode = rcode
+	set.Add(&Record{
+		RR:      soa,
+		Expires: time.Now().Add(time.Second * time.Duration(cache.ttls.Clamp(string(key.Name), ttl, true))),
+	})
+	cache.statistics.Insert()
+
+	shard, hash := cache.shard(key)
+	shard.setDomain(key, hash, map[dns.Type]*RecordSet{recordType: set}, cache.staleWindow, false)
+}
+
+// Call fn for every cached domain, least recently used first in each shard. Domains set or removed while this runs may
+// or may not be seen
+func (cache *Cache) ForEach(fn func(Key, *Domain)) {
+	for _, shard := range cache.shards {
+		for _, entry := range shard.entries() {
+			fn(entry.key, entry.domain)
+		}
+	}
+}
+
+func (cache *Cache) flush(match func(Key) bool) int {
+	removed := 0
+	for _, shard := range cache.shards {
+		removed += shard.flush(match)
+	}
+
+	return removed
+}
+
+// Drop a name for every class, flag and subnet it is cached under, returning the number of domains removed
+func (cache *Cache) FlushName(name string) int {
+	target := MakeKey(name, 0, false, false, "").Name
+	return cache.flush(func(key Key) bool {
+		return key.Name == target
+	})
+}
+
+// Drop a name and every name below it
+func (cache *Cache) FlushSuffix(suffix string) int {
+	suffix = dns.Fqdn(suffix)
+	return cache.flush(func(key Key) bool {
+		return dns.IsSubDomain(suffix, string(key.Name))
+	})
+}
+
+func (cache *Cache) FlushAll() int {
+	return cache.flush(func(Key) bool {
+		return true
+	})
 }
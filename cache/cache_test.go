@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var benchSizes = []int{1000, 10000}
+
+// Cache as it was before the LRU list and expiry heap, names are kept in insertion order and every new name scans the
+// whole order for expired domains before the oldest are dropped to make room
+type expireOrderCache struct {
+	expireOrder []dns.Name
+	domains     map[dns.Name]*expireOrderDomain
+	size        int
+	mutex       *sync.RWMutex
+}
+
+type expireOrderDomain struct {
+	expires time.Time
+	records []dns.RR
+}
+
+func makeExpireOrderCache(size int) *expireOrderCache {
+	return &expireOrderCache{
+		expireOrder: make([]dns.Name, size)[:0],
+		domains:     make(map[dns.Name]*expireOrderDomain, size),
+		size:        size,
+		mutex:       &sync.RWMutex{},
+	}
+}
+
+func (cache *expireOrderCache) clean() {
+	now := time.Now()
+	newPos := 0
+
+	cache.mutex.Lock()
+	for _, name := range cache.expireOrder {
+		domain := cache.domains[name]
+		if domain == nil {
+			continue
+		}
+
+		if !domain.expires.After(now) {
+			delete(cache.domains, name)
+		} else {
+			cache.expireOrder[newPos] = name
+			newPos++
+		}
+	}
+	cache.expireOrder = cache.expireOrder[:newPos]
+	cache.mutex.Unlock()
+}
+
+func (cache *expireOrderCache) deleteFirst() {
+	cache.mutex.Lock()
+	name := cache.expireOrder[0]
+	cache.expireOrder = cache.expireOrder[1:]
+	delete(cache.domains, name)
+	cache.mutex.Unlock()
+}
+
+func (cache *expireOrderCache) get(name dns.Name) []dns.RR {
+	cache.mutex.RLock()
+	domain := cache.domains[name]
+	cache.mutex.RUnlock()
+
+	if domain != nil && domain.expires.Before(time.Now()) {
+		cache.clean()
+		return nil
+	}
+	if domain == nil {
+		return nil
+	}
+
+	return domain.records
+}
+
+func (cache *expireOrderCache) set(name dns.Name, records []dns.RR) {
+	cache.mutex.RLock()
+	domain := cache.domains[name]
+	cache.mutex.RUnlock()
+
+	if domain == nil {
+		cache.clean()
+		if len(cache.expireOrder)+len(records) >= cache.size {
+			for range records {
+				cache.deleteFirst()
+			}
+		}
+	}
+
+	domain = &expireOrderDomain{records: records}
+	for _, record := range records {
+		if expires := time.Now().Add(time.Duration(record.Header().Ttl) * time.Second); domain.expires.Before(expires) {
+			domain.expires = expires
+		}
+	}
+
+	cache.mutex.Lock()
+	cache.expireOrder = append(cache.expireOrder, name)
+	cache.domains[name] = domain
+	cache.mutex.Unlock()
+}
+
+// Keys and A records for count distinct names
+func benchRecords(count int) ([]Key, [][]dns.RR) {
+	keys := make([]Key, count)
+	records := make([][]dns.RR, count)
+
+	for i := range keys {
+		keys[i] = MakeKey(fmt.Sprintf("host%d.example.com", i), dns.ClassINET, false, false, "")
+		records[i] = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: string(keys[i].Name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		}}
+	}
+
+	return keys, records
+}
+
+// Hits in the lru cache also count towards popularity and recency under the shard lock and follow aliases, so they stay
+// slower than a plain map lookup in the old cache. The gain is in BenchmarkCacheEvict, where the old cache scans every
+// name on each insert.
+func BenchmarkCacheGet(b *testing.B) {
+	for _, size := range benchSizes {
+		keys, records := benchRecords(size)
+
+		b.Run(fmt.Sprintf("lru/%d", size), func(b *testing.B) {
+			cache := MakeCache(size, 1)
+			for i, key := range keys {
+				cache.Set(key, records[i], false)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.Get(keys[i%size], dns.Type(dns.TypeA))
+			}
+		})
+
+		b.Run(fmt.Sprintf("expireOrder/%d", size), func(b *testing.B) {
+			cache := makeExpireOrderCache(size + 1)
+			for i, key := range keys {
+				cache.set(key.Name, records[i])
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.get(keys[i%size].Name)
+			}
+		})
+	}
+}
+
+// Replacing the records of names already in the cache, nothing has to be evicted
+func BenchmarkCacheSet(b *testing.B) {
+	for _, size := range benchSizes {
+		keys, records := benchRecords(size / 2)
+
+		b.Run(fmt.Sprintf("lru/%d", size), func(b *testing.B) {
+			cache := MakeCache(size, 1)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.Set(keys[i%len(keys)], records[i%len(keys)], false)
+			}
+		})
+
+		b.Run(fmt.Sprintf("expireOrder/%d", size), func(b *testing.B) {
+			cache := makeExpireOrderCache(size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.set(keys[i%len(keys)].Name, records[i%len(keys)])
+			}
+		})
+	}
+}
+
+// Inserting new names into a full cache, every insert evicts
+func BenchmarkCacheEvict(b *testing.B) {
+	for _, size := range benchSizes {
+		keys, records := benchRecords(size * 2)
+
+		b.Run(fmt.Sprintf("lru/%d", size), func(b *testing.B) {
+			cache := MakeCache(size, 1)
+			for i := 0; i < size; i++ {
+				cache.Set(keys[i], records[i], false)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.Set(keys[(size+i)%len(keys)], records[(size+i)%len(keys)], false)
+			}
+		})
+
+		b.Run(fmt.Sprintf("expireOrder/%d", size), func(b *testing.B) {
+			cache := makeExpireOrderCache(size)
+			for i := 0; i < size; i++ {
+				cache.set(keys[i].Name, records[i])
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.set(keys[(size+i)%len(keys)].Name, records[(size+i)%len(keys)])
+			}
+		})
+	}
+}
+
+func TestSetDropsOffChainRecords(t *testing.T) {
+	cache := MakeCache(100, 1)
+	key := MakeKey("www.example.com", dns.ClassINET, false, false, "")
+
+	answer := make([]dns.RR, 0, 4)
+	for _, text := range []string{
+		"www.example.com. 300 IN CNAME www.example.net.",
+		"example.net. 300 IN DNAME example.org.",
+		"www.example.org. 300 IN A 192.0.2.1",
+		"bank.example. 300 IN A 203.0.113.1",
+	} {
+		record, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer = append(answer, record)
+	}
+	cache.Set(key, answer, false)
+
+	if _, missing := cache.Get(key, dns.Type(dns.TypeA)); missing != "" {
+		t.Errorf("chain stopped at %s", missing)
+	}
+	if answer, missing := cache.Get(key.WithName("bank.example"), dns.Type(dns.TypeA)); missing == "" {
+		t.Errorf("record off the chain was cached: %v", answer.Records)
+	}
+}
+
+func TestPrefetchRetriesAfterFailure(t *testing.T) {
+	keys, records := benchRecords(1)
+	cache := MakeCache(10, 1)
+
+	refreshes := make(chan Key, 2)
+	cache.SetPrefetch(1, 1, func(key Key, recordType dns.Type) []dns.RR {
+		refreshes <- key
+		return nil
+	})
+	cache.Set(keys[0], records[0], false)
+
+	// Hits keep coming until a refresh starts, the second one only can once the first has failed
+	for i := 0; i < 2; i++ {
+		deadline := time.After(time.Second)
+	hits:
+		for {
+			cache.Get(keys[0], dns.Type(dns.TypeA))
+
+			select {
+			case <-refreshes:
+				break hits
+			case <-deadline:
+				t.Fatalf("refresh %d never started", i+1)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// Longest alias chain followed before giving up
+const maxChain = 8
+
+// Owner names reached from the key by following the cname and dname records of an answer, including the key itself
+func chainOwners(key Key, records []dns.RR) map[dns.Name]bool {
+	owners := map[dns.Name]bool{key.Name: true}
+	current := string(key.Name)
+
+	for hops := 0; hops < maxChain; hops++ {
+		next := ""
+		for _, record := range records {
+			switch alias := record.(type) {
+			case *dns.CNAME:
+				if strings.EqualFold(alias.Hdr.Name, current) {
+					next = alias.Target
+				}
+			case *dns.DNAME:
+				owner := key.WithName(alias.Hdr.Name).Name
+				if next == "" && owner != dns.Name(current) && dns.IsSubDomain(string(owner), current) {
+					owners[owner] = true
+					next = current[:len(current)-len(owner)] + dns.Fqdn(alias.Target)
+				}
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		name := key.WithName(next).Name
+		if owners[name] {
+			break
+		}
+		owners[name] = true
+		current = string(name)
+	}
+
+	return owners
+}
+
+// Closest ancestor of the name holding a dname record usable by pick, with the name rewritten below its target
+func (cache *Cache) findDname(key Key, pick func(*RecordSet) []dns.RR, now time.Time) (*dns.DNAME, dns.Name) {
+	name := string(key.Name)
+
+	for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+		ancestor := name[offset:]
+
+		domain := cache.peekDomain(key.WithName(ancestor), now)
+		if domain == nil {
+			continue
+		}
+
+		set := domain.Get(dns.Type(dns.TypeDNAME))
+		if set == nil {
+			continue
+		}
+
+		for _, record := range pick(set) {
+			if dname, ok := record.(*dns.DNAME); ok {
+				return dname, dns.Name(strings.ToLower(name[:offset] + dns.Fqdn(dname.Target)))
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// Walk cname and dname records from the key until a record set of the type, or a cached NXDOMAIN, is found. pick returns
+// the usable records of a set, and only lookups that touch count towards the popularity of the names. Returns the chain,
+// the final records with their set and key, or the name the chain stopped at when the records are missing. Loops and
+// chains past maxChain are treated as missing the original name.
+func (cache *Cache) chase(key Key, recordType dns.Type, pick func(*RecordSet) []dns.RR, touch bool, now time.Time) ([]dns.RR, []dns.RR, *RecordSet, Key, dns.Name) {
+	var output []dns.RR
+	var visited [maxChain + 1]dns.Name
+	current := key
+
+	lookup := cache.peekDomain
+	if touch {
+		lookup = cache.getDomain
+	}
+
+	for hops := 0; hops <= maxChain; hops++ {
+		for _, name := range visited[:hops] {
+			if name == current.Name {
+				return nil, nil, nil, key, key.Name
+			}
+		}
+		visited[hops] = current.Name
+
+		if domain := lookup(current, now); domain != nil {
+			if records := domain.Get(recordType); records != nil {
+				if rrs := pick(records); len(rrs) > 0 {
+					return output, rrs, records, current, ""
+				}
+			}
+
+			if records := domain.Get(nxdomainType); records != nil {
+				if rrs := pick(records); len(rrs) > 0 {
+					return output, rrs, records, current, ""
+				}
+			}
+
+			if recordType != dns.Type(dns.TypeCNAME) {
+				if cnames := domain.Get(dns.Type(dns.TypeCNAME)); cnames != nil {
+					if rrs := pick(cnames); len(rrs) > 0 {
+						if cname, ok := rrs[0].(*dns.CNAME); ok {
+							output = append(output, cname)
+							current = current.WithName(cname.Target)
+							continue
+						}
+					}
+				}
+			}
+		}
+
+		if recordType != dns.Type(dns.TypeDNAME) {
+			if dname, target := cache.findDname(current, pick, now); dname != nil {
+				output = append(output, dname, &dns.CNAME{
+					Hdr:    dns.RR_Header{Name: string(current.Name), Rrtype: dns.TypeCNAME, Class: dname.Hdr.Class, Ttl: dname.Hdr.Ttl},
+					Target: string(target),
+				})
+				current = current.WithName(string(target))
+				continue
+			}
+		}
+
+		return output, nil, nil, current, current.Name
+	}
+
+	return nil, nil, nil, key, key.Name
+}
@@ -20,30 +20,35 @@ func createDomain() *Domain {
 	}
 }
 
-func (domain *Domain) clean() {
-	now := time.Now()
-
+// Replaces the record set for the type, the domain expires with its longest lived record set
+func (domain *Domain) Set(dnsType dns.Type, records *RecordSet) {
 	domain.mutex.Lock()
-	for i, record := range domain.records {
-		if record.Expires.Before(now) {
-			delete(domain.records, i)
+	domain.records[dnsType] = records
+	domain.Expires = time.Time{}
+	for _, set := range domain.records {
+		if domain.Expires.Before(set.Expires) {
+			domain.Expires = set.Expires
 		}
 	}
 	domain.mutex.Unlock()
 }
 
-func (domain *Domain) delete(dnsType dns.Type) {
+func (domain *Domain) Expiry() time.Time {
+	domain.mutex.RLock()
+	expires := domain.Expires
+	domain.mutex.RUnlock()
+	return expires
+}
+
+func (domain *Domain) Delete(dnsType dns.Type) {
 	domain.mutex.Lock()
 	delete(domain.records, dnsType)
 	domain.mutex.Unlock()
 }
 
-func (domain *Domain) Set(dnsType dns.Type, records *RecordSet) {
+func (domain *Domain) Clear() {
 	domain.mutex.Lock()
-	domain.records[dnsType] = records
-	if domain.Expires.Before(records.Expires) {
-		domain.Expires = records.Expires
-	}
+	domain.records = make(map[dns.Type]*RecordSet, 1)
 	domain.mutex.Unlock()
 }
 
@@ -53,3 +58,28 @@ func (domain *Domain) Get(dnsType dns.Type) *RecordSet {
 	domain.mutex.RUnlock()
 	return records
 }
+
+// Number of records held across every record set
+func (domain *Domain) Len() int {
+	count := 0
+
+	domain.mutex.RLock()
+	for _, set := range domain.records {
+		count += set.Len()
+	}
+	domain.mutex.RUnlock()
+
+	return count
+}
+
+// Copy of the record sets by type
+func (domain *Domain) Sets() map[dns.Type]*RecordSet {
+	domain.mutex.RLock()
+	sets := make(map[dns.Type]*RecordSet, len(domain.records))
+	for dnsType, set := range domain.records {
+		sets[dnsType] = set
+	}
+	domain.mutex.RUnlock()
+
+	return sets
+}
@@ -0,0 +1,33 @@
+package cache
+
+// Min-heap of cache entries ordered by deadline, for use with container/heap
+type expiryHeap []*entry
+
+func (entries expiryHeap) Len() int {
+	return len(entries)
+}
+
+func (entries expiryHeap) Less(i, j int) bool {
+	return entries[i].deadline.Before(entries[j].deadline)
+}
+
+func (entries expiryHeap) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+	entries[i].index = i
+	entries[j].index = j
+}
+
+func (entries *expiryHeap) Push(value interface{}) {
+	current := value.(*entry)
+	current.index = len(*entries)
+	*entries = append(*entries, current)
+}
+
+func (entries *expiryHeap) Pop() interface{} {
+	old := *entries
+	current := old[len(old)-1]
+	old[len(old)-1] = nil
+	*entries = old[:len(old)-1]
+	current.index = -1
+	return current
+}
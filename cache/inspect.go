@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Entry sums up a cached domain for listings
+type Entry struct {
+	Key     Key
+	Types   []dns.Type
+	Records int
+	Expires time.Time
+}
+
+// RecordSetInfo is a record set as it is held in the cache, the records carry their remaining ttl
+type RecordSetInfo struct {
+	Key      Key
+	Type     dns.Type
+	Negative bool
+	Rcode    int
+	Hits     int64
+	Expires  time.Time
+	Records  []dns.RR
+}
+
+func sortedTypes(sets map[dns.Type]*RecordSet) []dns.Type {
+	types := make([]dns.Type, len(sets))[:0]
+	for dnsType := range sets {
+		types = append(types, dnsType)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+func lessKey(a, b Key) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Class != b.Class {
+		return a.Class < b.Class
+	}
+	if a.DO != b.DO {
+		return !a.DO
+	}
+	if a.CD != b.CD {
+		return !a.CD
+	}
+	return a.Subnet < b.Subnet
+}
+
+// Domains with names starting with the prefix sorted by key, skipping offset and returning at most limit of them (no
+// limit when 0), along with how many domains matched
+func (cache *Cache) List(prefix string, offset, limit int) ([]Entry, int) {
+	prefix = strings.ToLower(prefix)
+	var entries []Entry
+
+	cache.ForEach(func(key Key, domain *Domain) {
+		if !strings.HasPrefix(string(key.Name), prefix) {
+			return
+		}
+
+		entries = append(entries, Entry{
+			Key:     key,
+			Types:   sortedTypes(domain.Sets()),
+			Records: domain.Len(),
+			Expires: domain.Expiry(),
+		})
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return lessKey(entries[i].Key, entries[j].Key) })
+
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	entries = entries[offset:]
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	return entries, total
+}
+
+// Every record set cached for the name under any class, flags or subnet, expired records are given a ttl of 0
+func (cache *Cache) Inspect(name string) []RecordSetInfo {
+	now := time.Now()
+	target := MakeKey(name, 0, false, false, "")
+
+	// Keys that only differ by class, flags or subnet hash to the same shard
+	shard, _ := cache.shard(target)
+
+	var infos []RecordSetInfo
+	for _, entry := range shard.entries() {
+		if entry.key.Name != target.Name {
+			continue
+		}
+
+		sets := entry.domain.Sets()
+		for _, dnsType := range sortedTypes(sets) {
+			set := sets[dnsType]
+			records := set.Records()
+
+			rrs := make([]dns.RR, len(records))
+			for i, record := range records {
+				rrs[i] = dns.Copy(record.RR)
+				rrs[i].Header().Ttl = 0
+				if record.Expires.After(now) {
+					rrs[i].Header().Ttl = uint32(record.Expires.Sub(now) / time.Second)
+				}
+			}
+
+			negative, rcode := set.Negative()
+			infos = append(infos, RecordSetInfo{
+				Key:      entry.key,
+				Type:     dnsType,
+				Negative: negative,
+				Rcode:    rcode,
+				Hits:     set.Hits(),
+				Expires:  set.Expires,
+				Records:  rrs,
+			})
+		}
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool { return lessKey(infos[i].Key, infos[j].Key) })
+	return infos
+}
+
+// Put records in the cache as if they were answered upstream for plain queries of their owner and class, their ttls
+// still go through the ttl policy
+func (cache *Cache) Seed(records []dns.RR) {
+	byOwner := make(map[Key][]dns.RR, 1)
+	for _, record := range records {
+		key := MakeKey(record.Header().Name, record.Header().Class, false, false, "")
+		byOwner[key] = append(byOwner[key], record)
+	}
+
+	for key, ownerRecords := range byOwner {
+		cache.Set(key, ownerRecords, false)
+	}
+}
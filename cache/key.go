@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// Key is everything besides the record type that a cached answer depends on, names are always lower case
+type Key struct {
+	Name  dns.Name
+	Class dns.Class
+	// DNSSEC OK and checking disabled bits of the query
+	DO bool
+	CD bool
+	// Client subnet scope in CIDR form, empty unless client subnets are part of the key
+	Subnet string
+}
+
+func MakeKey(name string, class uint16, do, cd bool, subnet string) Key {
+	return Key{
+		Name:   dns.Name(strings.ToLower(dns.Fqdn(name))),
+		Class:  dns.Class(class),
+		DO:     do,
+		CD:     cd,
+		Subnet: subnet,
+	}
+}
+
+// Canonical key for the first question of a query, the client subnet is only used when withSubnet is set
+func QueryKey(msg *dns.Msg, withSubnet bool) Key {
+	question := msg.Question[0]
+	do := false
+	subnet := ""
+
+	if opt := msg.IsEdns0(); opt != nil {
+		do = opt.Do()
+
+		if withSubnet {
+			for _, option := range opt.Option {
+				if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+					bits := 32
+					if ecs.Family == 2 {
+						bits = 128
+					}
+
+					ipNet := net.IPNet{IP: ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits)), Mask: net.CIDRMask(int(ecs.SourceNetmask), bits)}
+					subnet = ipNet.String()
+				}
+			}
+		}
+	}
+
+	return MakeKey(question.Name, question.Qclass, do, msg.CheckingDisabled, subnet)
+}
+
+// Same key for another name, used for the owners of records in an answer and when following aliases
+func (key Key) WithName(name string) Key {
+	key.Name = dns.Name(strings.ToLower(dns.Fqdn(name)))
+	return key
+}
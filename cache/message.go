@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"github.com/Bob620/baka-dns/statistics"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+type MessageKey struct {
+	Key
+	Type uint16
+}
+
+type packedMessage struct {
+	key  MessageKey
+	wire []byte
+	// Offsets of every ttl field in wire
+	ttls []int
+	// Offsets of the owner names spelled out in full that are the question name, they take the case of each query
+	owners  []int
+	stored  time.Time
+	expires time.Time
+}
+
+// MessageCache holds packed responses so hits are answered by patching bytes instead of packing records
+type MessageCache struct {
+	messages   map[MessageKey]*list.Element
+	recent     *list.List
+	size       int
+	mutex      *sync.Mutex
+	statistics *statistics.Cache
+}
+
+var errBadMessage = errors.New("malformed dns message")
+
+func MakeMessageCache(size int, statistics *statistics.Cache) *MessageCache {
+	return &MessageCache{
+		messages:   make(map[MessageKey]*list.Element, size),
+		recent:     list.New(),
+		size:       size,
+		mutex:      &sync.Mutex{},
+		statistics: statistics,
+	}
+}
+
+func skipName(wire []byte, offset int) (int, error) {
+	for offset < len(wire) {
+		length := int(wire[offset])
+		switch length & 0xC0 {
+		case 0xC0:
+			return offset + 2, nil
+		case 0x00:
+			if length == 0 {
+				return offset + 1, nil
+			}
+			offset += 1 + length
+		default:
+			return 0, errBadMessage
+		}
+	}
+
+	return 0, errBadMessage
+}
+
+// Whether two packed names without compression pointers only differ in ASCII case
+func sameName(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		x, y := a[i], b[i]
+		if 'A' <= x && x <= 'Z' {
+			x += 'a' - 'A'
+		}
+		if 'A' <= y && y <= 'Z' {
+			y += 'a' - 'A'
+		}
+		if x != y {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Walk the packed message for the offset of each record's ttl, skipping the pseudo records that reuse the field, and
+// the offset of each owner name written out in full that is the question name. Owners compressed to a pointer at the
+// question follow its case anyway.
+func ttlOffsets(wire []byte) ([]int, []int, error) {
+	if len(wire) < 12 {
+		return nil, nil, errBadMessage
+	}
+
+	questions := int(binary.BigEndian.Uint16(wire[4:]))
+	records := int(binary.BigEndian.Uint16(wire[6:])) + int(binary.BigEndian.Uint16(wire[8:])) + int(binary.BigEndian.Uint16(wire[10:]))
+	offsets := make([]int, records)[:0]
+	var owners []int
+
+	offset := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if offset, err = skipName(wire, offset); err != nil {
+			return nil, nil, err
+		}
+		offset += 4
+	}
+
+	var question []byte
+	if questions > 0 {
+		end, _ := skipName(wire, 12)
+		question = wire[12:end]
+	}
+
+	for i := 0; i < records; i++ {
+		start := offset
+		if offset, err = skipName(wire, offset); err != nil {
+			return nil, nil, err
+		}
+		if offset+10 > len(wire) {
+			return nil, nil, errBadMessage
+		}
+
+		if question != nil && sameName(wire[start:offset], question) {
+			owners = append(owners, start)
+		}
+
+		rrType := binary.BigEndian.Uint16(wire[offset:])
+		if rrType != dns.TypeOPT && rrType != dns.TypeTSIG {
+			offsets = append(offsets, offset+4)
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(wire[offset+8:]))
+	}
+
+	if offset > len(wire) {
+		return nil, nil, errBadMessage
+	}
+
+	return offsets, owners, nil
+}
+
+// A copy of the cached response with the id, recursion desired bit and question case of the query, and ttls counted down
+func (messages *MessageCache) Get(key MessageKey, query *dns.Msg) []byte {
+	now := time.Now()
+
+	messages.mutex.Lock()
+	element := messages.messages[key]
+	if element == nil {
+		messages.mutex.Unlock()
+		return nil
+	}
+
+	message := element.Value.(*packedMessage)
+	if !message.expires.After(now) {
+		messages.recent.Remove(element)
+		delete(messages.messages, key)
+		messages.mutex.Unlock()
+		return nil
+	}
+	messages.recent.MoveToFront(element)
+	messages.mutex.Unlock()
+
+	wire := make([]byte, len(message.wire))
+	copy(wire, message.wire)
+
+	binary.BigEndian.PutUint16(wire, query.Id)
+	if query.RecursionDesired {
+		wire[2] |= 0x01
+	} else {
+		wire[2] &^= 0x01
+	}
+
+	// Names only differ in case so the packed question and owners keep their length
+	if _, err := dns.PackDomainName(query.Question[0].Name, wire, 12, nil, false); err != nil {
+		return nil
+	}
+	for _, offset := range message.owners {
+		if _, err := dns.PackDomainName(query.Question[0].Name, wire, offset, nil, false); err != nil {
+			return nil
+		}
+	}
+
+	elapsed := uint32(now.Sub(message.stored) / time.Second)
+	for _, offset := range message.ttls {
+		ttl := binary.BigEndian.Uint32(wire[offset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(wire[offset:], ttl)
+	}
+
+	messages.statistics.MessageHit()
+	return wire
+}
+
+// Keep a packed response until its shortest ttl runs out, responses without records are not kept
+func (messages *MessageCache) Set(key MessageKey, wire []byte) {
+	if messages.size <= 0 {
+		return
+	}
+
+	offsets, owners, err := ttlOffsets(wire)
+	if err != nil || len(offsets) == 0 {
+		return
+	}
+
+	minTtl := binary.BigEndian.Uint32(wire[offsets[0]:])
+	for _, offset := range offsets[1:] {
+		if ttl := binary.BigEndian.Uint32(wire[offset:]); ttl < minTtl {
+			minTtl = ttl
+		}
+	}
+	if minTtl == 0 {
+		return
+	}
+
+	now := time.Now()
+	message := &packedMessage{
+		key:     key,
+		wire:    append([]byte(nil), wire...),
+		ttls:    offsets,
+		owners:  owners,
+		stored:  now,
+		expires: now.Add(time.Duration(minTtl) * time.Second),
+	}
+
+	messages.mutex.Lock()
+	if element := messages.messages[key]; element != nil {
+		element.Value = message
+		messages.recent.MoveToFront(element)
+	} else {
+		messages.messages[key] = messages.recent.PushFront(message)
+	}
+
+	for messages.recent.Len() > messages.size {
+		oldest := messages.recent.Back()
+		messages.recent.Remove(oldest)
+		delete(messages.messages, oldest.Value.(*packedMessage).key)
+	}
+	messages.mutex.Unlock()
+}
+
+// Drop every packed response, responses hold whole alias chains so they can't be picked out by name
+func (messages *MessageCache) Clear() {
+	messages.mutex.Lock()
+	messages.messages = make(map[MessageKey]*list.Element, messages.size)
+	messages.recent.Init()
+	messages.mutex.Unlock()
+}
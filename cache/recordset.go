@@ -3,6 +3,7 @@ package cache
 import (
 	"github.com/miekg/dns"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,36 +14,78 @@ type Record struct {
 
 type RecordSet struct {
 	Expires time.Time
+	created time.Time
 	records []*Record
 	mutex   sync.RWMutex
+	// Set when inserted by a tangent query and not yet used by a client
+	tangent int32
+	// Client hits, and whether a refresh has been started for this set
+	hits       int64
+	refreshing int32
+	// Upstream time spent refreshing this set before it expired, claimed by the first client to use it
+	prefetchSaved int64
+	// Negative sets hold the SOA of a NXDOMAIN or NODATA answer
+	negative bool
+	rcode    int
+	// Copies handed out to clients during one second, replaced rather than modified so every hit in that second shares them
+	view atomic.Value
 }
 
-func createRecordSet() *RecordSet {
-	return &RecordSet{
-		Expires: time.Now(),
-		records: make([]*Record, 1)[:0],
-	}
+type recordView struct {
+	second  int64
+	records []dns.RR
 }
 
-func (records *RecordSet) clean() {
+func createRecordSet(tangent bool, prefetchSaved time.Duration) *RecordSet {
 	now := time.Now()
+	set := &RecordSet{
+		Expires:       now,
+		created:       now,
+		records:       make([]*Record, 1)[:0],
+		prefetchSaved: int64(prefetchSaved),
+	}
 
-	// Filter the Record set
-	newPos := 0
-	records.mutex.Lock()
-	for _, record := range records.records {
-		if record.Expires.After(now) {
-			records.records[newPos] = record
-			newPos++
-		}
+	if tangent {
+		set.tangent = 1
 	}
-	records.records = records.records[:newPos]
-	records.mutex.Unlock()
+
+	return set
+}
+
+// Count a hit, returns true once when the set is popular enough and inside the last fraction of its lifetime
+func (records *RecordSet) wantsRefresh(now time.Time, minHits int64, fraction float64) bool {
+	hits := atomic.AddInt64(&records.hits, 1)
+	if fraction <= 0 || hits < minHits {
+		return false
+	}
+
+	lifetime := records.Expires.Sub(records.created)
+	if records.Expires.Sub(now) > time.Duration(float64(lifetime)*fraction) {
+		return false
+	}
+
+	return atomic.CompareAndSwapInt32(&records.refreshing, 0, 1)
+}
+
+// Let the next hit start another refresh after one failed
+func (records *RecordSet) refreshFailed() {
+	atomic.StoreInt32(&records.refreshing, 0)
+}
+
+// Returns the upstream time saved the first time a client uses a prefetched record set
+func (records *RecordSet) claimPrefetch() time.Duration {
+	return time.Duration(atomic.SwapInt64(&records.prefetchSaved, 0))
+}
+
+// Returns true the first time a client uses a record set inserted by a tangent query
+func (records *RecordSet) claimTangent() bool {
+	return atomic.CompareAndSwapInt32(&records.tangent, 1, 0)
 }
 
 func (records *RecordSet) Add(record *Record) {
 	records.mutex.Lock()
 	records.records = append(records.records, record)
+	records.view.Store((*recordView)(nil))
 
 	if records.Expires.Before(record.Expires) {
 		records.Expires = record.Expires
@@ -50,18 +93,66 @@ func (records *RecordSet) Add(record *Record) {
 	records.mutex.Unlock()
 }
 
-func (records *RecordSet) GetRecords() []dns.RR {
+// Copies of the records still unexpired at the end of the current second with the ttl they have left then. The copies
+// are shared by every caller in the same second and must not be modified
+func (records *RecordSet) GetRecords(now time.Time) []dns.RR {
+	second := now.Unix()
+	if view, _ := records.view.Load().(*recordView); view != nil && view.second == second {
+		return view.records
+	}
+
+	end := time.Unix(second+1, 0)
+
+	records.mutex.RLock()
+	rrs := make([]dns.RR, len(records.records))[:0]
+	for _, record := range records.records {
+		if record.Expires.After(end) {
+			rr := dns.Copy(record.RR)
+			rr.Header().Ttl = uint32(record.Expires.Sub(end) / time.Second)
+			rrs = append(rrs, rr)
+		}
+	}
+	// Capped so appending to the shared slice never writes into it
+	rrs = rrs[:len(rrs):len(rrs)]
+	records.view.Store(&recordView{second: second, records: rrs})
+	records.mutex.RUnlock()
+
+	return rrs
+}
+
+// Copies of every record regardless of expiry, all given the same ttl
+func (records *RecordSet) GetStale(ttl uint32) []dns.RR {
 	records.mutex.RLock()
 	rrs := make([]dns.RR, len(records.records))
 	for i, record := range records.records {
-		record.RR.Header().Ttl = uint32(record.Expires.Sub(time.Now()) / time.Second)
-		rrs[i] = record.RR
+		rrs[i] = dns.Copy(record.RR)
+		rrs[i].Header().Ttl = ttl
 	}
 	records.mutex.RUnlock()
 
 	return rrs
 }
 
+// Copy of the records with their expiry, the records themselves are shared and must not be modified
+func (records *RecordSet) Records() []Record {
+	records.mutex.RLock()
+	copies := make([]Record, len(records.records))
+	for i, record := range records.records {
+		copies[i] = *record
+	}
+	records.mutex.RUnlock()
+
+	return copies
+}
+
+func (records *RecordSet) Negative() (bool, int) {
+	return records.negative, records.rcode
+}
+
 func (records *RecordSet) Len() int {
 	return len(records.records)
 }
+
+func (records *RecordSet) Hits() int64 {
+	return atomic.LoadInt64(&records.hits)
+}
@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"github.com/Bob620/baka-dns/statistics"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// A shard keeps its domains in W-TinyLFU order, new domains enter a small window and have to be looked up more often
+// than the least recently used domain of the main region to stay once the window overflows. Sizes count records.
+type shard struct {
+	domains    map[Key]*list.Element
+	window     *list.List
+	recent     *list.List
+	expiry     expiryHeap
+	frequency  *sketch
+	size       int
+	used       int
+	windowSize int
+	windowUsed int
+	mutex      *sync.RWMutex
+	statistics *statistics.Cache
+}
+
+type entry struct {
+	key      Key
+	hash     uint32
+	domain   *Domain
+	records  int
+	inWindow bool
+	// Time the entry is dropped, including the stale window, and its position in the expiry heap
+	deadline time.Time
+	index    int
+}
+
+func makeShard(size int, statistics *statistics.Cache) *shard {
+	windowSize := size / 100
+	if windowSize < 1 {
+		windowSize = 1
+	}
+
+	return &shard{
+		domains:    make(map[Key]*list.Element, size),
+		window:     list.New(),
+		recent:     list.New(),
+		expiry:     make(expiryHeap, size)[:0],
+		frequency:  makeSketch(size),
+		size:       size,
+		windowSize: windowSize,
+		mutex:      &sync.RWMutex{},
+		statistics: statistics,
+	}
+}
+
+// Must be called with the mutex held
+func (shard *shard) remove(element *list.Element) {
+	entry := element.Value.(*entry)
+
+	if entry.inWindow {
+		shard.window.Remove(element)
+		shard.windowUsed -= entry.records
+	} else {
+		shard.recent.Remove(element)
+	}
+
+	heap.Remove(&shard.expiry, entry.index)
+	delete(shard.domains, entry.key)
+	shard.used -= entry.records
+	shard.statistics.AddSize(int64(-entry.records))
+}
+
+// Drop every domain past its deadline, must be called with the mutex held
+func (shard *shard) expire(now time.Time) {
+	for len(shard.expiry) > 0 && !shard.expiry[0].deadline.After(now) {
+		shard.remove(shard.domains[shard.expiry[0].key])
+	}
+}
+
+// Must be called with the mutex held
+func (shard *shard) touch(element *list.Element) {
+	if element.Value.(*entry).inWindow {
+		shard.window.MoveToFront(element)
+	} else {
+		shard.recent.MoveToFront(element)
+	}
+}
+
+// Move the oldest window domain into the main region, keeping it only if it is more popular than what it pushes out.
+// The kept entry is never pushed out. Must be called with the mutex held
+func (shard *shard) admit(candidate *list.Element, keep *entry) {
+	current := candidate.Value.(*entry)
+
+	shard.window.Remove(candidate)
+	shard.windowUsed -= current.records
+	current.inWindow = false
+	candidate = shard.recent.PushFront(current)
+	shard.domains[current.key] = candidate
+
+	for shard.used > shard.size {
+		victim := shard.recent.Back()
+		if victim != nil && victim.Value.(*entry) == keep {
+			victim = victim.Prev()
+		}
+		if victim == nil || victim == candidate {
+			break
+		}
+
+		if shard.frequency.estimate(current.hash) <= shard.frequency.estimate(victim.Value.(*entry).hash) {
+			shard.remove(candidate)
+			shard.statistics.Reject()
+			return
+		}
+
+		shard.remove(victim)
+		shard.statistics.Evict()
+	}
+
+	shard.statistics.Admit()
+}
+
+// Least recently used entry other than keep, from the main region before the window
+func (shard *shard) oldest(keep *entry) *list.Element {
+	for _, region := range []*list.List{shard.recent, shard.window} {
+		for element := region.Back(); element != nil; element = element.Prev() {
+			if element.Value.(*entry) != keep {
+				return element
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evict until there is room without evicting the kept entry, entries are compared rather than their list elements
+// since admitting an entry moves it to a new element. Must be called with the mutex held
+func (shard *shard) evict(keep *entry) {
+	for shard.windowUsed > shard.windowSize && shard.window.Len() > 1 {
+		candidate := shard.window.Back()
+		if candidate.Value.(*entry) == keep {
+			candidate = candidate.Prev()
+		}
+		shard.admit(candidate, keep)
+	}
+
+	for shard.used > shard.size {
+		oldest := shard.oldest(keep)
+		if oldest == nil {
+			return
+		}
+
+		shard.remove(oldest)
+		shard.statistics.Evict()
+	}
+}
+
+// Look up a domain, only lookups that touch the domain count towards its popularity and recency. Lookups that don't
+// only take the read lock and leave expired domains for the next insert to drop
+func (shard *shard) getDomain(key Key, hash uint32, touch bool, now time.Time) *Domain {
+	if !touch {
+		shard.mutex.RLock()
+		defer shard.mutex.RUnlock()
+
+		element := shard.domains[key]
+		if element == nil || !element.Value.(*entry).deadline.After(now) {
+			return nil
+		}
+		return element.Value.(*entry).domain
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.frequency.increment(hash)
+
+	element := shard.domains[key]
+	if element == nil {
+		return nil
+	}
+
+	entry := element.Value.(*entry)
+	if !entry.deadline.After(now) {
+		shard.remove(element)
+		return nil
+	}
+
+	shard.touch(element)
+	return entry.domain
+}
+
+// Store record sets under the domain. New domains enter the window unless they are restored, restored domains were
+// admitted before and go straight into the main region.
+func (shard *shard) setDomain(key Key, hash uint32, sets map[dns.Type]*RecordSet, staleWindow time.Duration, restore bool) {
+	now := time.Now()
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.expire(now)
+
+	element := shard.domains[key]
+	if element == nil && restore {
+		current := &entry{key: key, hash: hash, domain: createDomain()}
+		element = shard.recent.PushFront(current)
+		shard.domains[key] = element
+		heap.Push(&shard.expiry, current)
+	} else if element == nil {
+		current := &entry{key: key, hash: hash, domain: createDomain(), inWindow: true}
+		element = shard.window.PushFront(current)
+		shard.domains[key] = element
+		heap.Push(&shard.expiry, current)
+	} else {
+		shard.touch(element)
+	}
+
+	// A name that does not exist has no other records, and any other record means it exists
+	current := element.Value.(*entry)
+	if _, ok := sets[nxdomainType]; ok {
+		current.domain.Clear()
+	} else {
+		current.domain.Delete(nxdomainType)
+	}
+
+	for recordType, set := range sets {
+		current.domain.Set(recordType, set)
+	}
+
+	records := current.domain.Len()
+	if current.inWindow {
+		shard.windowUsed += records - current.records
+	}
+	shard.used += records - current.records
+	shard.statistics.AddSize(int64(records - current.records))
+	current.records = records
+	current.deadline = current.domain.Expires.Add(staleWindow)
+	heap.Fix(&shard.expiry, current.index)
+
+	shard.evict(current)
+}
+
+// Keys and domains of every entry from least to most recently used, collected under the lock and handed out after it is
+// released
+func (shard *shard) entries() []*entry {
+	shard.mutex.Lock()
+	entries := make([]*entry, len(shard.domains))[:0]
+	for _, region := range []*list.List{shard.recent, shard.window} {
+		for element := region.Back(); element != nil; element = element.Prev() {
+			entries = append(entries, element.Value.(*entry))
+		}
+	}
+	shard.mutex.Unlock()
+
+	return entries
+}
+
+// Remove every domain whose key matches, returning how many were removed
+func (shard *shard) flush(match func(Key) bool) int {
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	removed := 0
+	for key, element := range shard.domains {
+		if match(key) {
+			shard.remove(element)
+			removed++
+		}
+	}
+
+	return removed
+}
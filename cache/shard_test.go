@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Lookups with one insert in ten, over twice as many names as fit so inserts keep evicting. Each shard count runs at
+// several GOMAXPROCS, shards=1 is a single lock for the whole cache and the baseline the other counts scale against.
+func BenchmarkCacheParallel(b *testing.B) {
+	const size = 10000
+	keys, records := benchRecords(size * 2)
+
+	procs := []int{1, 4, runtime.NumCPU()}
+	if procs[2] <= procs[1] {
+		procs = procs[:2]
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			for _, procs := range procs {
+				b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+					defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+					cache := MakeCache(size, shards)
+					for i := 0; i < size; i++ {
+						cache.Set(keys[i], records[i], false)
+					}
+
+					var next int64
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						i := int(atomic.AddInt64(&next, 7919))
+						for pb.Next() {
+							i = (i + 31) % len(keys)
+							if i%10 == 0 {
+								cache.Set(keys[i], records[i], false)
+							} else {
+								cache.Get(keys[i], dns.Type(dns.TypeA))
+							}
+						}
+					})
+				})
+			}
+		})
+	}
+}
+
+func TestShardStatistics(t *testing.T) {
+	const (
+		size      = 1000
+		shards    = 8
+		workers   = 8
+		perWorker = 2000
+	)
+
+	keys, records := benchRecords(size * 4)
+	cache := MakeCache(size, shards)
+	cache.Statistics().Reset()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				index := (worker*perWorker + i*13) % len(keys)
+				cache.Set(keys[index], records[index], false)
+				cache.Get(keys[(index+size)%len(keys)], dns.Type(dns.TypeA))
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	used := 0
+	for i, shard := range cache.shards {
+		shard.mutex.Lock()
+		if shard.used > shard.size {
+			t.Errorf("shard %d holds %d records, more than its %d", i, shard.used, shard.size)
+		}
+
+		records := 0
+		for _, element := range shard.domains {
+			records += element.Value.(*entry).domain.Len()
+		}
+		if records != shard.used {
+			t.Errorf("shard %d counts %d records but holds %d", i, shard.used, records)
+		}
+
+		used += shard.used
+		shard.mutex.Unlock()
+	}
+
+	statistics := cache.Statistics()
+	if size := statistics.GetSize(); size != int64(used) {
+		t.Errorf("size is %d but the shards hold %d records", size, used)
+	}
+	if lookups := statistics.GetHits() + statistics.GetMisses(); lookups != workers*perWorker {
+		t.Errorf("%d hits and misses for %d lookups", lookups, workers*perWorker)
+	}
+	if inserts := statistics.GetInsertions(); inserts != workers*perWorker {
+		t.Errorf("%d insertions for %d records set", inserts, workers*perWorker)
+	}
+}
+
+func TestAdmissionFollowsClients(t *testing.T) {
+	const size = 100
+	keys, records := benchRecords(size * 6)
+	cache := MakeCache(size, 1)
+	cache.Statistics().Reset()
+
+	// Clients keep asking for the popular name, mostly answered from the message cache
+	popular := keys[0]
+	cache.Set(popular, records[0], false)
+	for i := 0; i < 10; i++ {
+		cache.Touch(popular)
+	}
+
+	// Background lookups for names nobody asked for don't count
+	shard, hash := cache.shard(keys[1])
+	for i := 0; i < 10; i++ {
+		cache.Missing(keys[1], dns.Type(dns.TypeA))
+	}
+	if estimate := shard.frequency.estimate(hash); estimate != 0 {
+		t.Errorf("background lookups counted %d times", estimate)
+	}
+
+	// A flood of names asked for once
+	for i := 1; i < len(keys); i++ {
+		cache.Get(keys[i], dns.Type(dns.TypeA))
+		cache.Set(keys[i], records[i], false)
+	}
+
+	if _, missing := cache.Get(popular, dns.Type(dns.TypeA)); missing != "" {
+		t.Error("popular name was pushed out by one-off misses")
+	}
+	if rejections := cache.Statistics().GetRejections(); rejections == 0 {
+		t.Error("no one-off misses were rejected")
+	}
+}
+
+func TestSetKeepsStoredEntry(t *testing.T) {
+	const size = 10
+	keys, records := benchRecords(size * 3)
+	cache := MakeCache(size, 1)
+
+	for i := 0; i < 1000; i++ {
+		index := (i * 7) % len(keys)
+		// Names come back with more records than before so updates grow entries already in the main region
+		set := records[index]
+		for extra := 0; extra < i%3; extra++ {
+			record := dns.Copy(records[index][0]).(*dns.A)
+			record.A = net.IPv4(198, 51, 100, byte(extra))
+			set = append(set, record)
+		}
+		if i%5 == 0 {
+			cache.Touch(keys[(index+1)%len(keys)])
+		}
+
+		cache.Set(keys[index], set, false)
+		if cache.peekDomain(keys[index], time.Now()) == nil {
+			t.Fatalf("%s was evicted while it was stored", keys[index].Name)
+		}
+	}
+}
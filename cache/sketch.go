@@ -0,0 +1,68 @@
+package cache
+
+// Count-min sketch of how often names are looked up, counters saturate at 15 and are halved as the sample fills up
+// so the estimate follows recent popularity
+type sketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	sample    int
+}
+
+var sketchSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+func makeSketch(capacity int) *sketch {
+	width := 64
+	for width < capacity {
+		width <<= 1
+	}
+
+	counts := &sketch{
+		mask:   uint64(width - 1),
+		sample: width * 10,
+	}
+	for i := range counts.rows {
+		counts.rows[i] = make([]uint8, width)
+	}
+
+	return counts
+}
+
+func (counts *sketch) index(hash uint32, row int) uint64 {
+	mixed := (uint64(hash) ^ sketchSeeds[row]) * 0x9e3779b97f4a7c15
+	return (mixed >> 32) & counts.mask
+}
+
+func (counts *sketch) increment(hash uint32) {
+	for i := range counts.rows {
+		index := counts.index(hash, i)
+		if counts.rows[i][index] < 15 {
+			counts.rows[i][index]++
+		}
+	}
+
+	counts.additions++
+	if counts.additions >= counts.sample {
+		counts.reset()
+	}
+}
+
+func (counts *sketch) estimate(hash uint32) uint8 {
+	estimate := uint8(15)
+	for i := range counts.rows {
+		if count := counts.rows[i][counts.index(hash, i)]; count < estimate {
+			estimate = count
+		}
+	}
+
+	return estimate
+}
+
+func (counts *sketch) reset() {
+	for i := range counts.rows {
+		for j := range counts.rows[i] {
+			counts.rows[i][j] >>= 1
+		}
+	}
+	counts.additions /= 2
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Bump the version whenever snapshotSet changes, older snapshots are then ignored
+const (
+	snapshotMagic   = "baka-dns cache snapshot"
+	snapshotVersion = 1
+)
+
+var errSnapshotVersion = errors.New("incompatible cache snapshot")
+
+type snapshotHeader struct {
+	Magic   string
+	Version int
+	Saved   time.Time
+}
+
+type snapshotSet struct {
+	Key      Key
+	Type     uint16
+	Negative bool
+	Rcode    int
+	// Records in wire format with the absolute time each expires
+	Records [][]byte
+	Expires []time.Time
+}
+
+func packRecord(record dns.RR) ([]byte, error) {
+	wire := make([]byte, dns.Len(record))
+	offset, err := dns.PackRR(record, wire, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire[:offset], nil
+}
+
+// Write every unexpired record set to the path, through a temporary file so a crash never leaves half a snapshot
+func (cache *Cache) Save(path string) (int, error) {
+	now := time.Now()
+	saved := 0
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	encoder := gob.NewEncoder(file)
+	if err := encoder.Encode(snapshotHeader{snapshotMagic, snapshotVersion, now}); err != nil {
+		_ = file.Close()
+		return 0, err
+	}
+
+	cache.ForEach(func(key Key, domain *Domain) {
+		for dnsType, set := range domain.Sets() {
+			negative, rcode := set.Negative()
+			entry := snapshotSet{Key: key, Type: uint16(dnsType), Negative: negative, Rcode: rcode}
+
+			for _, record := range set.Records() {
+				if !record.Expires.After(now) {
+					continue
+				}
+
+				if wire, err := packRecord(record.RR); err == nil {
+					entry.Records = append(entry.Records, wire)
+					entry.Expires = append(entry.Expires, record.Expires)
+				}
+			}
+
+			if len(entry.Records) > 0 && err == nil {
+				err = encoder.Encode(entry)
+				saved++
+			}
+		}
+	})
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return saved, os.Rename(file.Name(), filepath.Clean(path))
+}
+
+// Read a snapshot back, records keep their original expiry so time spent down counts against them. Nothing is loaded
+// unless the whole snapshot can be read.
+func (cache *Cache) Load(path string) (int, error) {
+	now := time.Now()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decoder := gob.NewDecoder(file)
+
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return 0, err
+	}
+	if header.Magic != snapshotMagic || header.Version != snapshotVersion {
+		return 0, errSnapshotVersion
+	}
+
+	var entries []snapshotSet
+	for {
+		var entry snapshotSet
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(entry.Records) != len(entry.Expires) {
+			return 0, errSnapshotVersion
+		}
+
+		entries = append(entries, entry)
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		set := createRecordSet(false, 0)
+		set.negative = entry.Negative
+		set.rcode = entry.Rcode
+
+		for i, wire := range entry.Records {
+			if !entry.Expires[i].After(now) {
+				continue
+			}
+
+			record, _, err := dns.UnpackRR(wire, 0)
+			if err != nil {
+				continue
+			}
+
+			set.Add(&Record{RR: record, Expires: entry.Expires[i]})
+		}
+
+		if set.Len() > 0 {
+			shard, hash := cache.shard(entry.Key)
+			shard.setDomain(entry.Key, hash, map[dns.Type]*RecordSet{dns.Type(entry.Type): set}, cache.staleWindow, true)
+			loaded++
+		}
+	}
+
+	return loaded, nil
+}
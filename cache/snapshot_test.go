@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadRestoresFullCache(t *testing.T) {
+	const size = 100
+
+	dir, err := ioutil.TempDir("", "baka-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	keys, records := benchRecords(size)
+	saved := MakeCache(size, 1)
+	for i, key := range keys {
+		saved.Set(key, records[i], false)
+	}
+	// The first names are the most recently used when the snapshot is taken
+	for _, key := range keys[:10] {
+		saved.Get(key, dns.Type(dns.TypeA))
+	}
+	count, err := saved.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := MakeCache(size, 1)
+	if loaded, err := restored.Load(path); err != nil || loaded != count {
+		t.Fatalf("loaded %d of %d record sets: %v", loaded, count, err)
+	}
+
+	now := time.Now()
+	missing := 0
+	saved.ForEach(func(key Key, domain *Domain) {
+		if restored.peekDomain(key, now) == nil {
+			missing++
+		}
+	})
+	if missing > 0 {
+		t.Errorf("%d of %d saved names were lost on load", missing, count)
+	}
+
+	// A smaller cache keeps the most recently used names without any of them going through admission
+	smaller := MakeCache(size/2, 1)
+	smaller.Statistics().Reset()
+	if _, err := smaller.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[:10] {
+		if smaller.peekDomain(key, now) == nil {
+			t.Errorf("recently used %s was lost on load", key.Name)
+		}
+	}
+	if rejections := smaller.Statistics().GetRejections(); rejections > 0 {
+		t.Errorf("%d restored names went through admission", rejections)
+	}
+}
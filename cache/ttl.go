@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// TTLRule forces the ttl of every record under the suffix, a leading "*." only matches names below the suffix
+type TTLRule struct {
+	Suffix string
+	Ttl    uint32
+}
+
+// TTLPolicy clamps upstream ttls as records are inserted, a max of 0 leaves ttls uncapped
+type TTLPolicy struct {
+	MinTtl         uint32
+	MaxTtl         uint32
+	NegativeMinTtl uint32
+	NegativeMaxTtl uint32
+	Overrides      []TTLRule
+}
+
+func (rule TTLRule) matches(name string) bool {
+	suffix := strings.ToLower(dns.Fqdn(rule.Suffix))
+	if strings.HasPrefix(suffix, "*.") {
+		suffix = suffix[2:]
+		return name != suffix && dns.IsSubDomain(suffix, name)
+	}
+
+	return dns.IsSubDomain(suffix, name)
+}
+
+// The ttl a record with the owner name should be cached and served with
+func (policy *TTLPolicy) Clamp(name string, ttl uint32, negative bool) uint32 {
+	if policy == nil {
+		return ttl
+	}
+
+	name = strings.ToLower(name)
+	matched := -1
+	for i, rule := range policy.Overrides {
+		if rule.matches(name) && (matched == -1 || len(rule.Suffix) > len(policy.Overrides[matched].Suffix)) {
+			matched = i
+		}
+	}
+	if matched != -1 {
+		return policy.Overrides[matched].Ttl
+	}
+
+	min, max := policy.MinTtl, policy.MaxTtl
+	if negative {
+		min, max = policy.NegativeMinTtl, policy.NegativeMaxTtl
+	}
+
+	if ttl < min {
+		ttl = min
+	}
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+// Negative ttl of a response from its SOA record (RFC 2308), false when there is no SOA to take it from
+func negativeTtl(ns []dns.RR) (*dns.SOA, uint32, bool) {
+	for _, record := range ns {
+		if soa, ok := record.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return soa, ttl, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+// Copy of an upstream response with its ttls clamped the same way they are when cached
+func (policy *TTLPolicy) ClampMsg(msg *dns.Msg) *dns.Msg {
+	msg = msg.Copy()
+
+	for _, record := range msg.Answer {
+		record.Header().Ttl = policy.Clamp(record.Header().Name, record.Header().Ttl, false)
+	}
+
+	if len(msg.Question) > 0 && (len(msg.Answer) == 0 || msg.Rcode == dns.RcodeNameError) {
+		if soa, ttl, ok := negativeTtl(msg.Ns); ok {
+			soa.Hdr.Ttl = policy.Clamp(msg.Question[0].Name, ttl, true)
+		}
+	}
+
+	return msg
+}
@@ -0,0 +1,281 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/Bob620/baka-dns/upstream/pool"
+)
+
+type Redis struct {
+	Address string `json:"address"`
+	Basis   string `json:"basis"`
+	// AUTH password, along with the ACL user when one is given, and the logical database
+	Username string        `json:"username"`
+	Password string        `json:"password"`
+	Db       int           `json:"db"`
+	Tls      RedisTLS      `json:"tls"`
+	Sentinel RedisSentinel `json:"sentinel"`
+	// Whether readiness checks fail while redis is down
+	Required bool `json:"required"`
+	// Id tagging the cache invalidations this node publishes, defaults to the host name and pid
+	NodeId string `json:"node-id"`
+	// Milliseconds a local miss waits on redis before going upstream
+	Timeout int `json:"timeout"`
+}
+
+type RedisTLS struct {
+	Enabled bool `json:"enabled"`
+	// CA certificate to verify redis with, the system pool is used when empty
+	CA string `json:"ca"`
+	// Client certificate and key for mutual TLS
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server-name"`
+}
+
+type RedisSentinel struct {
+	// Name of the monitored master, empty turns sentinel discovery off and address is used directly
+	Master    string   `json:"master"`
+	Addresses []string `json:"addresses"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+}
+
+type Blocklist struct {
+	// Lists in hosts, plain domain or adblock syntax, and lists of names that are never blocked
+	Lists []string `json:"lists"`
+	Allow []string `json:"allow"`
+	// Seconds between reloading the lists, 0 only loads them at startup
+	Refresh int `json:"refresh"`
+	// One of nxdomain, null or refused, and the ttl of null answers
+	Response string `json:"response"`
+	Ttl      uint32 `json:"ttl"`
+}
+
+type Rpz struct {
+	// Policy zones in order of precedence
+	Zones []RpzZone `json:"zones"`
+	// Seconds between reloading the zones, 0 only loads them at startup
+	Refresh int `json:"refresh"`
+}
+
+type RpzZone struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type Zones struct {
+	// Zones served authoritatively ahead of the cache and upstreams
+	Zones []LocalZone `json:"zones"`
+	// Seconds between checking the zone files for changes, 0 only loads them at startup
+	Check int        `json:"check"`
+	Empty EmptyZones `json:"empty"`
+}
+
+type EmptyZones struct {
+	// Serve the RFC 6303 empty zones for private and special use address space
+	Enabled bool `json:"enabled"`
+	// Zones left to be resolved upstream as usual
+	Exclude []string `json:"exclude"`
+}
+
+type LocalZone struct {
+	Origin string `json:"origin"`
+	Path   string `json:"path"`
+}
+
+type Hosts struct {
+	// Files in /etc/hosts syntax answering address and reverse lookups
+	Files []string `json:"files"`
+	Ttl   uint32   `json:"ttl"`
+	// Seconds between checking the files for changes, 0 only loads them at startup
+	Check int `json:"check"`
+}
+
+type Update struct {
+	// TSIG keys allowed to send dynamic updates, updates aren't accepted without any
+	Keys []TsigKey `json:"keys"`
+}
+
+type TsigKey struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	// Base64 encoded secret
+	Secret string `json:"secret"`
+	// Local zones the key may update
+	Zones []string `json:"zones"`
+}
+
+type Http struct {
+	// Address of the health, readiness and metrics endpoints, empty turns them off
+	Listen string `json:"listen"`
+	// Bearer token for the admin API, empty turns the admin API off
+	Token string `json:"token"`
+}
+
+type Cache struct {
+	Size   int `json:"size"`
+	Shards int `json:"shards"`
+	// Packed responses kept in the message cache
+	Messages int `json:"messages"`
+	// Forward client subnets upstream and keep answers per subnet
+	ClientSubnet bool `json:"client-subnet"`
+	// Clamps on upstream ttls, a max of 0 leaves them uncapped, and forced ttls for names under a suffix
+	MinTtl         uint32        `json:"min-ttl"`
+	MaxTtl         uint32        `json:"max-ttl"`
+	NegativeMinTtl uint32        `json:"negative-min-ttl"`
+	NegativeMaxTtl uint32        `json:"negative-max-ttl"`
+	TtlOverrides   []TTLOverride `json:"ttl-overrides"`
+	Prefetch       CachePrefetch `json:"prefetch"`
+}
+
+type TTLOverride struct {
+	Suffix string `json:"suffix"`
+	Ttl    uint32 `json:"ttl"`
+}
+
+type CachePrefetch struct {
+	// Hits needed before a record set is refreshed, and the fraction of its ttl left when it is, 0 turns it off
+	MinHits  int64   `json:"min-hits"`
+	Fraction float64 `json:"fraction"`
+}
+
+type Stale struct {
+	// Seconds expired records are kept, 0 turns serving stale answers off
+	Window int    `json:"window"`
+	Ttl    uint32 `json:"ttl"`
+	// Milliseconds to wait on upstreams before answering with a stale record
+	ClientTimeout int `json:"client-timeout"`
+}
+
+type Persistence struct {
+	// Cache snapshot file, empty turns snapshots off, and seconds between snapshots
+	Path     string `json:"path"`
+	Interval int    `json:"interval"`
+}
+
+type Tangent struct {
+	// One of off, static or learned
+	Policy     string   `json:"policy"`
+	Types      []string `json:"types"`
+	Window     int      `json:"window"`
+	Threshold  float64  `json:"threshold"`
+	MinSamples int64    `json:"min-samples"`
+}
+
+type Config struct {
+	Listen          string        `json:"listen"`
+	Upstreams       []pool.Server `json:"upstreams"`
+	Workers         int           `json:"workers"`
+	PrefetchWorkers int           `json:"prefetch-workers"`
+	PrefetchQueue   int           `json:"prefetch-queue"`
+	Cache           Cache         `json:"cache"`
+	Stale           Stale         `json:"stale"`
+	Persistence     Persistence   `json:"persistence"`
+	Redis           Redis         `json:"redis"`
+	Tangent         Tangent       `json:"tangent"`
+	Blocklist       Blocklist     `json:"blocklist"`
+	Rpz             Rpz           `json:"rpz"`
+	Local           Zones         `json:"local"`
+	Hosts           Hosts         `json:"hosts"`
+	Update          Update        `json:"update"`
+	// CSV file every response is logged to, empty turns the query log off
+	QueryLog string `json:"query-log"`
+	Http     Http   `json:"http"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen: ":53",
+		Upstreams: []pool.Server{
+			{Name: "cloudflared", Address: "192.168.2.1", Port: "5353", Priority: 0},
+			{Name: "1.1.1.1", Address: "1.1.1.1", Port: "53", Priority: 1},
+			{Name: "1.0.0.1", Address: "1.0.0.1", Port: "53", Priority: 2},
+		},
+		Workers:         10,
+		PrefetchWorkers: 4,
+		PrefetchQueue:   64,
+		Cache: Cache{
+			Size:           100,
+			Shards:         4,
+			Messages:       1000,
+			MaxTtl:         86400,
+			NegativeMaxTtl: 3600,
+			Prefetch: CachePrefetch{
+				MinHits:  5,
+				Fraction: 0.1,
+			},
+		},
+		Stale: Stale{
+			Window:        86400,
+			Ttl:           30,
+			ClientTimeout: 1800,
+		},
+		Persistence: Persistence{
+			Interval: 300,
+		},
+		Redis: Redis{
+			Address: "127.0.0.1:64444",
+			Basis:   "baka-dns:urls",
+			Timeout: 50,
+		},
+		Tangent: Tangent{
+			Policy:     "static",
+			Types:      []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"},
+			Window:     10,
+			Threshold:  0.5,
+			MinSamples: 5,
+		},
+		Blocklist: Blocklist{
+			Refresh:  3600,
+			Response: "nxdomain",
+			Ttl:      60,
+		},
+		Rpz: Rpz{
+			Refresh: 3600,
+		},
+		Local: Zones{
+			Check: 5,
+		},
+		Hosts: Hosts{
+			Ttl:   60,
+			Check: 5,
+		},
+	}
+}
+
+// Load the config file over the defaults, a missing file leaves the defaults in place
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Write the config out in full, through a temporary file so a crash never leaves half a config behind. It can hold
+// passwords so only the owner may read it.
+func Save(path string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
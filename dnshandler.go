@@ -1,74 +1,502 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/Bob620/baka-dns/authority"
+	"github.com/Bob620/baka-dns/blocklist"
 	"github.com/Bob620/baka-dns/cache"
+	"github.com/Bob620/baka-dns/hosts"
+	"github.com/Bob620/baka-dns/rpz"
+	"github.com/Bob620/baka-dns/tangent"
 	"github.com/Bob620/baka-dns/upstream/pool"
 	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
 )
 
 type DnsHandler struct {
-	redisPool  *RedisPool
-	dnsPool    *pool.Pool
-	localCache *cache.Cache
+	redisPool    *RedisPool
+	dnsPool      *pool.Pool
+	localCache   *cache.Cache
+	messageCache *cache.MessageCache
+	tangents     tangent.Policy
+	// How long a client waits on upstreams before being given a stale answer
+	clientTimeout time.Duration
+	// Whether client subnets are forwarded and part of cache keys
+	clientSubnet bool
+	// Blocked names are answered with the block response before the cache is looked at
+	blocklist     *blocklist.Blocklist
+	blockResponse string
+	blockTtl      uint32
+	// Response policy zones, checked before the blocklist, and the name servers found for their NSDNAME triggers
+	rpz      *rpz.Policy
+	nsCache  *nameServerCache
+	queryLog *QueryLog
+	// Zones answered authoritatively instead of from the cache or upstreams
+	zones *authority.Zones
+	hosts *hosts.Hosts
+	// Applies dynamic updates to the local zones, updates aren't implemented without it
+	updater *Updater
 }
 
-func MakeDNSHandler(redisPool *RedisPool, dnsPool *pool.Pool, localCache *cache.Cache) *DnsHandler {
-	return &DnsHandler{redisPool, dnsPool, localCache}
+func MakeDNSHandler(redisPool *RedisPool, dnsPool *pool.Pool, localCache *cache.Cache, messageCache *cache.MessageCache, tangents tangent.Policy, clientTimeout time.Duration, clientSubnet bool) *DnsHandler {
+	return &DnsHandler{redisPool: redisPool, dnsPool: dnsPool, localCache: localCache, messageCache: messageCache, tangents: tangents, clientTimeout: clientTimeout, clientSubnet: clientSubnet}
 }
 
-func (handler DnsHandler) cache(name string, typ uint16, tangent bool) *dns.Msg {
-	result, onlyCname := handler.localCache.Get(dns.Name(name), dns.Type(typ))
-	if result == nil || onlyCname {
-		dnsRes, source, _ := handler.dnsPool.Do(pool.Message{Name: name, Type: typ})
+func (handler *DnsHandler) SetBlocklist(blocklist *blocklist.Blocklist, response string, ttl uint32) {
+	handler.blocklist = blocklist
+	handler.blockResponse = response
+	handler.blockTtl = ttl
+}
 
-		if dnsRes != nil {
-			go fmt.Printf("%s (T:%s) found in %s (P:%d) with %d answers\n", name, dns.TypeToString[typ], source.Name, source.Priority, len(dnsRes.Answer))
+func (handler *DnsHandler) SetPolicy(policy *rpz.Policy) {
+	handler.rpz = policy
+	handler.nsCache = makeNameServerCache()
+}
+
+func (handler *DnsHandler) SetZones(zones *authority.Zones) {
+	handler.zones = zones
+}
+
+func (handler *DnsHandler) SetUpdater(updater *Updater) {
+	handler.updater = updater
+}
+
+func (handler *DnsHandler) SetHosts(hosts *hosts.Hosts) {
+	handler.hosts = hosts
+}
+
+func (handler *DnsHandler) SetQueryLog(queryLog *QueryLog) {
+	handler.queryLog = queryLog
+}
+
+// Copies of the records with owner names matching the question given the question's case
+func matchCase(records []dns.RR, name string) []dns.RR {
+	matched := make([]dns.RR, len(records))
+	for i, record := range records {
+		if record.Header().Name != name && strings.EqualFold(record.Header().Name, name) {
+			record = dns.Copy(record)
+			record.Header().Name = name
+		}
+		matched[i] = record
+	}
+
+	return matched
+}
+
+func (handler DnsHandler) ServeDNS(writer dns.ResponseWriter, msg *dns.Msg) {
+	defer writer.Close()
 
-			if dnsRes.Rcode == dns.RcodeSuccess {
-				go func() {
-					if len(dnsRes.Answer) > 0 {
-						handler.localCache.Set(dns.Name(name), dnsRes.Answer, tangent)
-					}
-				}()
+	if msg.Opcode == dns.OpcodeUpdate && handler.updater != nil {
+		res, changed := handler.updater.Update(msg, writer.TsigStatus())
+		if len(msg.Question) == 1 {
+			handler.queryLog.Log(writer.RemoteAddr().String(), &msg.Question[0], dns.RcodeToString[res.Rcode], len(changed), "update")
+		}
+		_ = writer.WriteMsg(res)
+		handler.updater.Flush(changed)
+
+		return
+	}
 
-				return dnsRes
+	if msg.Opcode != dns.OpcodeQuery || len(msg.Question) != 1 {
+		msg.Rcode = dns.RcodeNotImplemented
+		_ = writer.WriteMsg(msg)
+
+		return
+	}
+
+	question := msg.Question[0]
+	key := cache.QueryKey(msg, handler.clientSubnet)
+	messageKey := cache.MessageKey{Key: key, Type: question.Qtype}
+
+	// Only client questions teach the tangents, lookups made while answering them don't
+	handler.tangents.Observe(string(key.Name), question.Qtype)
+
+	// Message cache keys don't hold the client, so clients with a policy rule of their own never share cached answers
+	client := writer.RemoteAddr()
+	shared := handler.rpz == nil || handler.rpz.ClientIP(addrIP(client)) == nil
+
+	// Packed responses only need their id, question case and ttls patched
+	if shared {
+		if wire := handler.messageCache.Get(messageKey, msg); wire != nil {
+			go fmt.Printf("%s found in message cache\n", question.Name)
+			handler.localCache.Touch(key)
+			handler.queryLog.Log(client.String(), &question, dns.RcodeToString[int(wire[3]&0x0F)], int(binary.BigEndian.Uint16(wire[6:])), "")
+			_, _ = writer.Write(wire)
+			return
+		}
+	}
+
+	resolution, err := handler.Do(&question, key, client)
+
+	if err == nil && resolution.Drop {
+		handler.queryLog.Log(client.String(), &question, "DROP", 0, resolution.Policy)
+		return
+	}
+
+	msg.RecursionAvailable = true
+	msg.Response = true
+	policy := ""
+
+	if err == nil {
+		res := resolution.Msg
+		msg.Authoritative = res.Authoritative
+		msg.AuthenticatedData = res.AuthenticatedData
+		msg.Truncated = res.Truncated
+		msg.Ns = res.Ns
+		msg.Extra = res.Extra
+		msg.Rcode = res.Rcode
+		msg.Answer = matchCase(res.Answer, question.Name)
+		policy = resolution.Policy
+	} else {
+		msg.Rcode = dns.RcodeServerFailure
+	}
+
+	handler.queryLog.Log(client.String(), &question, dns.RcodeToString[msg.Rcode], len(msg.Answer), policy)
+	cacheable := err == nil && resolution.Cacheable && shared
+
+	wire, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	if cacheable {
+		handler.messageCache.Set(messageKey, wire)
+	}
+
+	_, _ = writer.Write(wire)
+}
+
+// Upstream query for the key, keeping its class, flags and client subnet
+func upstreamMessage(key cache.Key, typ uint16, priority pool.Priority) pool.Message {
+	return pool.Message{
+		Name:             string(key.Name),
+		Type:             typ,
+		Class:            uint16(key.Class),
+		Priority:         priority,
+		DnssecOk:         key.DO,
+		CheckingDisabled: key.CD,
+		Subnet:           key.Subnet,
+	}
+}
+
+// Name at the end of the alias chain in an answer
+func chainEnd(name string, answer []dns.RR) string {
+	for range answer {
+		next := ""
+		for _, record := range answer {
+			if cname, ok := record.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	return name
+}
+
+func hasType(answer []dns.RR, typ uint16) bool {
+	for _, record := range answer {
+		if record.Header().Rrtype == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Key of a response shared with other instances through redis
+func sharedKey(key cache.Key, typ uint16) string {
+	return fmt.Sprintf("%s:%d:%d:%t:%t:%s", key.Name, key.Class, typ, key.DO, key.CD, key.Subnet)
+}
+
+// Put an answer in the local cache, NXDOMAIN and NODATA answers are cached for the end of their chain
+func (handler DnsHandler) store(key cache.Key, typ uint16, dnsRes *dns.Msg, tangent bool) {
+	if len(dnsRes.Answer) > 0 {
+		handler.localCache.Set(key, dnsRes.Answer, tangent)
+	}
+
+	if dnsRes.Rcode == dns.RcodeNameError || !hasType(dnsRes.Answer, typ) {
+		end := key.WithName(chainEnd(string(key.Name), dnsRes.Answer))
+		handler.localCache.SetNegative(end, dns.Type(typ), dnsRes.Rcode, dnsRes.Ns, tangent)
+	}
+}
+
+// Resolve the key through redis, then upstream, and cache the answer locally and in redis
+func (handler DnsHandler) upstream(key cache.Key, typ uint16, tangent bool) *dns.Msg {
+	if handler.redisPool != nil {
+		if dnsRes := handler.redisPool.GetMsg(sharedKey(key, typ)); dnsRes != nil {
+			go fmt.Printf("%s (T:%s) found in redis with %d answers\n", key.Name, dns.TypeToString[typ], len(dnsRes.Answer))
+			go handler.store(key, typ, dnsRes, tangent)
+			return dnsRes
+		}
+	}
+
+	priority := pool.Interactive
+	if tangent {
+		priority = pool.Prefetch
+	}
+
+	dnsRes, source, _ := handler.dnsPool.Do(upstreamMessage(key, typ, priority))
+
+	if dnsRes != nil {
+		go fmt.Printf("%s (T:%s) found in %s (P:%d) with %d answers\n", key.Name, dns.TypeToString[typ], source.Name, source.Priority, len(dnsRes.Answer))
+
+		if dnsRes.Rcode == dns.RcodeSuccess || dnsRes.Rcode == dns.RcodeNameError {
+			dnsRes = handler.localCache.TTLPolicy().ClampMsg(dnsRes)
+
+			go handler.store(key, typ, dnsRes, tangent)
+			if handler.redisPool != nil {
+				go handler.redisPool.SetMsg(sharedKey(key, typ), dnsRes)
 			}
+
+			return dnsRes
 		}
 	}
 
 	return nil
 }
 
-func (handler DnsHandler) Do(question *dns.Question) (*dns.Msg, error) {
+// Resolve whatever part of the answer is missing from the cache
+func (handler DnsHandler) cache(key cache.Key, typ uint16, tangent bool) *dns.Msg {
+	if missing := handler.localCache.Missing(key, dns.Type(typ)); missing != "" {
+		return handler.upstream(key.WithName(string(missing)), typ, tangent)
+	}
+
+	return nil
+}
+
+// Re-resolve a popular record set at low priority before it expires
+func (handler DnsHandler) refresh(key cache.Key, typ dns.Type) []dns.RR {
+	dnsRes, _, err := handler.dnsPool.Do(upstreamMessage(key, uint16(typ), pool.Prefetch))
+	if err != nil || dnsRes == nil || dnsRes.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	return dnsRes.Answer
+}
+
+func (handler DnsHandler) refreshStale(key cache.Key, typ uint16) {
+	if records := handler.refresh(key, dns.Type(typ)); len(records) > 0 {
+		handler.localCache.Set(key, records, false)
+	}
+}
+
+// First blocked name an answer's alias chain goes through, empty when there is none
+func (handler DnsHandler) cloakedName(answer []dns.RR) string {
+	for _, record := range answer {
+		if name := strings.ToLower(record.Header().Name); handler.blocklist.Blocked(name) {
+			return name
+		}
+
+		if cname, ok := record.(*dns.CNAME); ok {
+			if target := strings.ToLower(cname.Target); handler.blocklist.Blocked(target) {
+				return target
+			}
+		}
+	}
+
+	return ""
+}
+
+// Resolution is the answer to a client's question along with how it was reached
+type Resolution struct {
+	Msg *dns.Msg
+	// Whether the answer may be kept in the message cache
+	Cacheable bool
+	// Policy that decided the answer, empty when it was resolved as normal
+	Policy string
+	// Leave the query unanswered
+	Drop bool
+}
+
+func (handler DnsHandler) blocked(question *dns.Question, policy string) *Resolution {
+	return &Resolution{Msg: blockedResponse(handler.blockResponse, question, handler.blockTtl), Policy: policy}
+}
+
+// Resolve a client's question, applying response policies and the blocklist around the cache and upstreams. Answers
+// decided by a policy or the blocklist aren't kept in the message cache so changes to them take effect straight away.
+func (handler DnsHandler) Do(question *dns.Question, key cache.Key, client net.Addr) (*Resolution, error) {
 	go fmt.Printf("Searching for %s with record type %s\n", question.Name, dns.TypeToString[question.Qtype])
 
-	// Local cache lookup
-	result, onlyCname := handler.localCache.Get(dns.Name(question.Name), dns.Type(question.Qtype))
+	// The first policy zone with a matching trigger wins. Client and query name triggers are known before anything is
+	// resolved, so their rule is applied straight away unless the zones before its own have triggers for the answer.
+	var rule *rpz.Rule
+	zones := 0
+	if handler.rpz != nil {
+		rule, zones = handler.rpz.Query(addrIP(client), string(key.Name))
+	}
+
+	// A passthru skips every other check
+	passthru := false
+	if rule != nil && !handler.rpz.HasResponseTriggers(zones) {
+		go fmt.Printf("%s matched %s\n", question.Name, rule)
+		if resolution, err := handler.applyRule(rule, question, key, client); resolution != nil || err != nil {
+			return resolution, err
+		}
+		passthru, rule = rule.Action == rpz.Passthru, nil
+	}
+
+	if rule == nil && !passthru && handler.blocklist != nil && handler.blocklist.Blocked(string(key.Name)) {
+		go fmt.Printf("%s blocked\n", question.Name)
+		return handler.blocked(question, "blocklist"), nil
+	}
 
-	if result != nil && !onlyCname {
-		go fmt.Printf("%s found in local cache with %d answers\n", question.Name, len(result))
-		return &dns.Msg{Answer: result}, nil
+	res, cacheable, err := handler.resolve(question, key)
+	if err != nil || passthru {
+		return &Resolution{Msg: res, Cacheable: cacheable}, err
+	}
+
+	if handler.rpz != nil {
+		// A rule still waiting on the answer applies when the earlier zones have nothing for it
+		if response := handler.responseRule(key, res, zones); response != nil {
+			rule = response
+		}
+
+		if rule != nil {
+			go fmt.Printf("%s matched %s\n", question.Name, rule)
+			if resolution, err := handler.applyRule(rule, question, key, client); resolution != nil || err != nil {
+				return resolution, err
+			}
+			if rule.Action == rpz.Passthru {
+				return &Resolution{Msg: res, Cacheable: cacheable}, nil
+			}
+		}
+	}
+
+	// Trackers hide behind aliases of first party names, so every name in the chain is checked too
+	if handler.blocklist != nil {
+		if cloaked := handler.cloakedName(res.Answer); cloaked != "" {
+			go fmt.Printf("%s blocked, cloaking %s\n", question.Name, cloaked)
+			return handler.blocked(question, "blocklist "+cloaked), nil
+		}
+	}
+
+	return &Resolution{Msg: res, Cacheable: cacheable}, nil
+}
+
+// Answer a question from the hosts files and local zones, or from the cache and upstreams for anything else
+func (handler DnsHandler) resolve(question *dns.Question, key cache.Key) (*dns.Msg, bool, error) {
+	if handler.hosts != nil && key.Class == dns.ClassINET {
+		if answer, ok := handler.hosts.Lookup(string(key.Name), question.Qtype); ok {
+			go fmt.Printf("%s found in hosts files with %d answers\n", question.Name, len(answer))
+			return &dns.Msg{MsgHdr: dns.MsgHdr{Authoritative: true}, Answer: answer}, true, nil
+		}
+	}
+
+	if handler.zones != nil && key.Class == dns.ClassINET {
+		if res := handler.zones.Lookup(string(key.Name), question.Qtype); res != nil {
+			go fmt.Printf("%s answered from local zone with %d answers\n", question.Name, len(res.Answer))
+			return handler.local(question, key, res, 0)
+		}
+	}
+
+	return handler.lookup(question, key)
+}
+
+// Follow an alias out of a local zone through the other local zones, the cache and upstreams
+func (handler DnsHandler) local(question *dns.Question, key cache.Key, res *dns.Msg, depth int) (*dns.Msg, bool, error) {
+	// Negative answers and referrals carry an authority section, only answers that leave the zone don't
+	if len(res.Answer) == 0 || len(res.Ns) > 0 || hasType(res.Answer, question.Qtype) || question.Qtype == dns.TypeCNAME || depth >= 8 {
+		return res, true, nil
+	}
+
+	end := chainEnd(string(key.Name), res.Answer)
+	next := &dns.Question{Name: end, Qtype: question.Qtype, Qclass: question.Qclass}
+	nextKey := key.WithName(end)
+
+	var rest *dns.Msg
+	var cacheable bool
+	var err error
+	if local := handler.zones.Lookup(string(nextKey.Name), question.Qtype); local != nil {
+		rest, cacheable, err = handler.local(next, nextKey, local, depth+1)
+	} else {
+		rest, cacheable, err = handler.lookup(next, nextKey)
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	answer := *rest
+	answer.Authoritative = res.Authoritative
+	answer.Answer = append(append([]dns.RR{}, res.Answer...), rest.Answer...)
+	return &answer, cacheable, nil
+}
+
+// Answer a question from the cache, or upstream when the cache can't
+func (handler DnsHandler) lookup(question *dns.Question, key cache.Key) (*dns.Msg, bool, error) {
+	// Local cache lookup, following aliases as far as the cache goes
+	answer, missing := handler.localCache.Get(key, dns.Type(question.Qtype))
+
+	if missing == "" {
+		go fmt.Printf("%s found in local cache with %d answers\n", question.Name, len(answer.Records))
+		return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: answer.Rcode}, Answer: answer.Records, Ns: answer.Ns}, true, nil
+	}
+
+	var chain []dns.RR
+	if answer != nil {
+		chain = answer.Records
 	}
 
 	// Tangent queries
-	go func(name string, qType uint16) {
-		go handler.cache(name, dns.TypeA, true)
-		go handler.cache(name, dns.TypeAAAA, true)
-		go handler.cache(name, dns.TypeCNAME, true)
-		go handler.cache(name, dns.TypeMX, true)
-		go handler.cache(name, dns.TypeNS, true)
-		go handler.cache(name, dns.TypeTXT, true)
-	}(question.Name, question.Qtype)
-
-	// Query upstream DNS
-	dnsRes := handler.cache(question.Name, question.Qtype, false)
-
-	// Catch if all of the upstream resolvers fail and return an error
-	if dnsRes != nil {
-		return dnsRes, nil
+	go func(key cache.Key, qType uint16) {
+		for _, typ := range handler.tangents.Tangents(string(key.Name), qType) {
+			go handler.cache(key, typ, true)
+		}
+	}(key, question.Qtype)
+
+	// Query upstream DNS for the end of the chain, then put the cached part of the chain in front of the answer
+	resultChan := make(chan *dns.Msg, 1)
+	go func() {
+		dnsRes := handler.upstream(key.WithName(string(missing)), question.Qtype, false)
+		if dnsRes != nil && len(chain) > 0 {
+			answer := *dnsRes
+			answer.Answer = append(chain, dnsRes.Answer...)
+			dnsRes = &answer
+		}
+
+		resultChan <- dnsRes
+	}()
+
+	var timeout <-chan time.Time
+	if handler.clientTimeout > 0 {
+		timer := time.NewTimer(handler.clientTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case dnsRes := <-resultChan:
+		if dnsRes != nil {
+			return dnsRes, true, nil
+		}
+
+		// All of the upstream resolvers failed, try again in the background while answering stale
+		if stale := handler.localCache.GetStale(key, dns.Type(question.Qtype)); stale != nil {
+			go fmt.Printf("%s served stale with %d answers\n", question.Name, len(stale))
+			go handler.refreshStale(key, question.Qtype)
+			return &dns.Msg{Answer: stale}, false, nil
+		}
+	case <-timeout:
+		// Upstreams are too slow, refresh in the background like a failure in case the running query never finishes
+		if stale := handler.localCache.GetStale(key, dns.Type(question.Qtype)); stale != nil {
+			go fmt.Printf("%s served stale with %d answers\n", question.Name, len(stale))
+			go handler.refreshStale(key, question.Qtype)
+			return &dns.Msg{Answer: stale}, false, nil
+		}
+
+		if dnsRes := <-resultChan; dnsRes != nil {
+			return dnsRes, true, nil
+		}
 	}
 
-	return nil, errors.New("nxdomain")
+	return nil, false, errors.New("all upstreams failed")
 }
@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/mediocregopher/radix/v3 v3.5.2
 	github.com/miekg/dns v1.1.29
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 )
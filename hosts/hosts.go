@@ -0,0 +1,214 @@
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bob620/baka-dns/reload"
+	"github.com/miekg/dns"
+)
+
+type table struct {
+	// Addresses by lower cased, fully qualified name
+	addresses map[string][]net.IP
+	// First name given for an address by its reverse name
+	names map[string]string
+}
+
+func makeTable() *table {
+	return &table{addresses: map[string][]net.IP{}, names: map[string]string{}}
+}
+
+func (table *table) has(name string, ip net.IP) bool {
+	for _, address := range table.addresses[name] {
+		if address.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read a hosts file, lines that aren't an address followed by names are skipped
+func (table *table) parse(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Link local addresses can carry a zone, fe80::1%eth0
+		address := fields[0]
+		if zone := strings.IndexByte(address, '%'); zone >= 0 {
+			address = address[:zone]
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			name := strings.ToLower(dns.Fqdn(field))
+			if _, ok := dns.IsDomainName(name); !ok || name == "." {
+				continue
+			}
+
+			if !table.has(name, ip) {
+				table.addresses[name] = append(table.addresses[name], ip)
+			}
+			if _, ok := table.names[reverse]; !ok {
+				table.names[reverse] = name
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Hosts answers address and reverse lookups from hosts files, the files are read again when any of them changes
+type Hosts struct {
+	paths   []string
+	ttl     uint32
+	table   *table
+	mutex   *sync.RWMutex
+	watcher *reload.Watcher
+}
+
+func MakeHosts(paths []string, ttl uint32) (*Hosts, error) {
+	hosts := &Hosts{paths: paths, ttl: ttl, table: makeTable(), mutex: &sync.RWMutex{}, watcher: reload.MakeWatcher()}
+	return hosts, hosts.Reload()
+}
+
+// Read every file again, the old entries stay in place unless all of the files load
+func (hosts *Hosts) Reload() error {
+	table := makeTable()
+	modified := map[string]time.Time{}
+
+	for _, path := range hosts.paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		info, err := file.Stat()
+		if err == nil {
+			modified[path] = info.ModTime()
+			err = table.parse(file)
+		}
+		_ = file.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	hosts.mutex.Lock()
+	hosts.table = table
+	hosts.mutex.Unlock()
+
+	// Files are only marked as read once all of them load, so a failed reload is tried again at the next check
+	for path, modTime := range modified {
+		hosts.watcher.Read(path, modTime)
+	}
+
+	hosts.watcher.Reloaded()
+	return nil
+}
+
+// Called after every successful reload
+func (hosts *Hosts) SetOnReload(onReload func()) {
+	hosts.watcher.SetOnReload(onReload)
+}
+
+func (hosts *Hosts) changed() bool {
+	for _, path := range hosts.paths {
+		if hosts.watcher.Changed(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reload the files whenever one of them has changed, checking every interval
+func (hosts *Hosts) CheckEvery(interval time.Duration) {
+	reload.Every(interval, func() {
+		if !hosts.changed() {
+			return
+		}
+
+		if err := hosts.Reload(); err != nil {
+			fmt.Println("Unable to reload hosts files, keeping the old entries:", err)
+			return
+		}
+
+		fmt.Printf("Reloaded hosts files with %d names\n", hosts.Entries())
+	})
+}
+
+func (hosts *Hosts) Entries() int {
+	hosts.mutex.RLock()
+	defer hosts.mutex.RUnlock()
+
+	return len(hosts.table.addresses)
+}
+
+// Answer for a lower cased, fully qualified name. A and AAAA questions for names in the files are always answered, with
+// no records when the name has no address of that family, and PTR questions are answered with the first name given
+// for the address. Anything else isn't answered.
+func (hosts *Hosts) Lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	hosts.mutex.RLock()
+	table := hosts.table
+	hosts.mutex.RUnlock()
+
+	header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: hosts.ttl}
+
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addresses, ok := table.addresses[name]
+		if !ok {
+			return nil, false
+		}
+
+		var answer []dns.RR
+		for _, ip := range addresses {
+			if qtype == dns.TypeA && len(ip) == net.IPv4len {
+				answer = append(answer, &dns.A{Hdr: header, A: ip})
+			} else if qtype == dns.TypeAAAA && len(ip) == net.IPv6len {
+				answer = append(answer, &dns.AAAA{Hdr: header, AAAA: ip})
+			}
+		}
+
+		return answer, true
+	case dns.TypePTR:
+		target, ok := table.names[name]
+		if !ok {
+			return nil, false
+		}
+
+		return []dns.RR{&dns.PTR{Hdr: header, Ptr: target}}, true
+	}
+
+	return nil, false
+}
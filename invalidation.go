@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Bob620/baka-dns/cache"
+	"github.com/miekg/dns"
+)
+
+// Channel under the redis basis that invalidations are published on
+const invalidationChannel = "invalidate"
+
+// Scopes of an invalidation
+const (
+	FlushName   = "name"
+	FlushSuffix = "suffix"
+	FlushAll    = "all"
+)
+
+var errBadScope = errors.New("flush scope must be name, suffix or all")
+
+type Invalidation struct {
+	// Node the flush was made on, nodes ignore their own invalidations
+	Node  string `json:"node"`
+	Scope string `json:"scope"`
+	Name  string `json:"name,omitempty"`
+}
+
+// Invalidator flushes the local caches and tells every other node sharing the redis basis to do the same
+type Invalidator struct {
+	node         string
+	redisPool    *RedisPool
+	localCache   *cache.Cache
+	messageCache *cache.MessageCache
+}
+
+// Node id that is unique enough between instances when none is configured
+func defaultNodeId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "baka-dns"
+	}
+
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func MakeInvalidator(node string, redisPool *RedisPool, localCache *cache.Cache, messageCache *cache.MessageCache) *Invalidator {
+	if node == "" {
+		node = defaultNodeId()
+	}
+
+	return &Invalidator{node, redisPool, localCache, messageCache}
+}
+
+func (invalidator *Invalidator) Node() string {
+	return invalidator.node
+}
+
+// Drop the matching domains from the local caches, returning how many were removed
+func (invalidator *Invalidator) apply(scope, name string) (int, error) {
+	var removed int
+
+	switch scope {
+	case FlushName:
+		removed = invalidator.localCache.FlushName(name)
+	case FlushSuffix:
+		removed = invalidator.localCache.FlushSuffix(name)
+	case FlushAll:
+		removed = invalidator.localCache.FlushAll()
+	default:
+		return 0, errBadScope
+	}
+
+	invalidator.messageCache.Clear()
+	return removed, nil
+}
+
+// Redis key pattern of the shared responses covered by the flush
+func sharedPatterns(scope, name string) []string {
+	name = globEscape(string(cache.MakeKey(name, 0, false, false, "").Name))
+
+	switch scope {
+	case FlushName:
+		return []string{name + ":*"}
+	case FlushSuffix:
+		if name == "." {
+			return []string{"*"}
+		}
+		return []string{name + ":*", "*." + name + ":*"}
+	default:
+		return []string{"*"}
+	}
+}
+
+func checkFlush(scope, name string) error {
+	switch scope {
+	case FlushName, FlushSuffix:
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("%q is not a domain name", name)
+		}
+	case FlushAll:
+	default:
+		return errBadScope
+	}
+
+	return nil
+}
+
+// Flush this node, the responses shared in redis and every other node, returning how many local domains were removed
+func (invalidator *Invalidator) Flush(scope, name string) (int, error) {
+	if err := checkFlush(scope, name); err != nil {
+		return 0, err
+	}
+
+	removed, err := invalidator.apply(scope, name)
+	if err != nil {
+		return 0, err
+	}
+
+	go fmt.Printf("Flushed %d domains (%s %s)\n", removed, scope, name)
+
+	// Without redis there are no shared responses or other nodes to flush
+	if invalidator.redisPool == nil {
+		return removed, nil
+	}
+
+	// Other nodes would just fetch the flushed responses back out of redis
+	for _, pattern := range sharedPatterns(scope, name) {
+		if _, err := invalidator.redisPool.DeleteMatching(pattern); err != nil {
+			return removed, err
+		}
+	}
+
+	event, err := json.Marshal(Invalidation{Node: invalidator.node, Scope: scope, Name: name})
+	if err != nil {
+		return removed, err
+	}
+
+	if res := <-invalidator.redisPool.Publish(invalidationChannel, string(event)); res.err != nil {
+		return removed, res.err
+	}
+
+	return removed, nil
+}
+
+// Flush names from this node, then from the responses shared in redis with one scan for all of them and from every
+// other node. Meant to run in the background, redis is scanned whole so it takes as long as redis is big.
+func (invalidator *Invalidator) FlushNames(names []string) {
+	prefixes := make([]string, len(names))
+	removed := 0
+
+	for i, name := range names {
+		count, _ := invalidator.apply(FlushName, name)
+		removed += count
+		prefixes[i] = string(cache.MakeKey(name, 0, false, false, "").Name) + ":"
+	}
+
+	go fmt.Printf("Flushed %d domains (%d names)\n", removed, len(names))
+
+	if invalidator.redisPool == nil {
+		return
+	}
+
+	if _, err := invalidator.redisPool.DeletePrefixed(prefixes); err != nil {
+		go fmt.Println("Unable to flush", len(names), "names from redis:", err)
+		return
+	}
+
+	for _, name := range names {
+		event, err := json.Marshal(Invalidation{Node: invalidator.node, Scope: FlushName, Name: name})
+		if err != nil {
+			continue
+		}
+
+		if res := <-invalidator.redisPool.Publish(invalidationChannel, string(event)); res.err != nil {
+			go fmt.Println("Unable to flush", name, "from other nodes:", res.err)
+			return
+		}
+	}
+}
+
+// Apply invalidations published by other nodes until the process exits
+func (invalidator *Invalidator) Listen() {
+	if invalidator.redisPool == nil {
+		return
+	}
+
+	invalidator.redisPool.Subscribe(invalidationChannel, func(message string) {
+		var event Invalidation
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			go fmt.Println("Ignoring malformed invalidation:", err)
+			return
+		}
+
+		if event.Node == invalidator.node {
+			return
+		}
+
+		removed, err := invalidator.apply(event.Scope, event.Name)
+		if err != nil {
+			go fmt.Println("Ignoring invalidation from", event.Node, err)
+			return
+		}
+
+		go fmt.Printf("Flushed %d domains (%s %s) for %s\n", removed, event.Scope, event.Name, event.Node)
+	})
+}
@@ -9,32 +9,58 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/Bob620/baka-dns/authority"
+	"github.com/Bob620/baka-dns/blocklist"
 	"github.com/Bob620/baka-dns/cache"
+	"github.com/Bob620/baka-dns/config"
+	"github.com/Bob620/baka-dns/hosts"
+	"github.com/Bob620/baka-dns/rpz"
+	"github.com/Bob620/baka-dns/tangent"
 	"github.com/Bob620/baka-dns/upstream"
 	"github.com/Bob620/baka-dns/upstream/pool"
 	"github.com/miekg/dns"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-const port = ":53"
-
 func main() {
 	var dnsPool *pool.Pool
 	var redisPool *RedisPool
 	var localCache *cache.Cache
 
-	redisPool, err := MakeRedisPool("127.0.0.1:64444", "baka-dns:urls")
+	configPath := flag.String("config", "baka-dns.json", "path to the config file")
+	flag.Parse()
+
+	conf, err := config.Load(*configPath)
 	if err != nil {
-		fmt.Println("Unable to connect to redis")
+		fmt.Println("Unable to read config:", err)
+		return
+	}
+
+	tangents, err := tangent.MakePolicy(conf.Tangent.Policy, conf.Tangent.Types, time.Duration(conf.Tangent.Window)*time.Second, conf.Tangent.Threshold, conf.Tangent.MinSamples)
+	if err != nil {
+		fmt.Println("Unable to set up tangent queries:", err)
+		return
+	}
+
+	redisPool, err = MakeRedisPool(conf.Redis)
+	if redisPool == nil && err != nil {
+		fmt.Println("Unable to set up redis:", err)
+		return
+	} else if redisPool == nil {
+		fmt.Println("No redis address, answers are only cached locally")
+	} else if err != nil {
+		fmt.Println("Unable to connect to redis, retrying in the background")
 	} else {
 		fmt.Println("Connected to redis")
 	}
 
-	dnsPool = upstream.MakeUpstreamPool(10, &[]pool.Server{
-		{"cloudflared", "192.168.2.1", "5353", 0},
-		{"1.1.1.1", "1.1.1.1", "53", 1},
-		{"1.0.0.1", "1.0.0.1", "53", 2},
-	})
+	dnsPool = upstream.MakeUpstreamPool(conf.Workers, conf.PrefetchWorkers, conf.PrefetchQueue, &conf.Upstreams)
 
 	fmt.Printf("Found %d operatonal authorative dns servers\n", dnsPool.NumUpstreams())
 
@@ -43,52 +69,201 @@ func main() {
 		return
 	}
 
-	localCache = cache.MakeCache(100)
+	localCache = cache.MakeCache(conf.Cache.Size, conf.Cache.Shards)
+
+	ttlPolicy := &cache.TTLPolicy{
+		MinTtl:         conf.Cache.MinTtl,
+		MaxTtl:         conf.Cache.MaxTtl,
+		NegativeMinTtl: conf.Cache.NegativeMinTtl,
+		NegativeMaxTtl: conf.Cache.NegativeMaxTtl,
+	}
+	for _, override := range conf.Cache.TtlOverrides {
+		ttlPolicy.Overrides = append(ttlPolicy.Overrides, cache.TTLRule{Suffix: override.Suffix, Ttl: override.Ttl})
+	}
+	localCache.SetTTLPolicy(ttlPolicy)
 
 	// Create dns handling function
-	dnsHandler := MakeDNSHandler(redisPool, dnsPool, localCache)
+	messageCache := cache.MakeMessageCache(conf.Cache.Messages, localCache.Statistics())
+	dnsHandler := MakeDNSHandler(redisPool, dnsPool, localCache, messageCache, tangents, time.Duration(conf.Stale.ClientTimeout)*time.Millisecond, conf.Cache.ClientSubnet)
+	localCache.SetStale(time.Duration(conf.Stale.Window)*time.Second, conf.Stale.Ttl)
+	localCache.SetPrefetch(conf.Cache.Prefetch.MinHits, conf.Cache.Prefetch.Fraction, dnsHandler.refresh)
+
+	var blocks *blocklist.Blocklist
+	if len(conf.Blocklist.Lists) > 0 {
+		if err = checkBlockResponse(conf.Blocklist.Response); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		blocks, err = blocklist.MakeBlocklist(conf.Blocklist.Lists, conf.Blocklist.Allow)
+		if err != nil {
+			fmt.Println("Unable to load blocklists:", err)
+			return
+		}
+
+		blocked, allowed := blocks.Entries()
+		fmt.Printf("Loaded blocklists with %d blocked and %d allowed entries\n", blocked, allowed)
+
+		// Packed responses for newly blocked names would skip the blocklist
+		blocks.SetOnReload(messageCache.Clear)
+		dnsHandler.SetBlocklist(blocks, conf.Blocklist.Response, conf.Blocklist.Ttl)
+
+		if conf.Blocklist.Refresh > 0 {
+			go blocks.ReloadEvery(time.Duration(conf.Blocklist.Refresh) * time.Second)
+		}
+	}
+
+	if len(conf.Rpz.Zones) > 0 {
+		files := make([]rpz.ZoneFile, len(conf.Rpz.Zones))
+		for i, zone := range conf.Rpz.Zones {
+			files[i] = rpz.ZoneFile{Name: zone.Name, Path: zone.Path}
+		}
+
+		policy, err := rpz.MakePolicy(files)
+		if err != nil {
+			fmt.Println("Unable to load policy zones:", err)
+			return
+		}
+		fmt.Printf("Loaded %d policy zones\n", len(files))
+
+		policy.SetOnReload(messageCache.Clear)
+		dnsHandler.SetPolicy(policy)
+
+		if conf.Rpz.Refresh > 0 {
+			go policy.ReloadEvery(time.Duration(conf.Rpz.Refresh) * time.Second)
+		}
+	}
+
+	var zones *authority.Zones
+	if len(conf.Local.Zones) > 0 || conf.Local.Empty.Enabled {
+		files := make([]authority.ZoneFile, len(conf.Local.Zones))
+		for i, zone := range conf.Local.Zones {
+			files[i] = authority.ZoneFile{Origin: zone.Origin, Path: zone.Path}
+		}
 
-	server := dns.Server{
-		Addr: port,
-		Net:  "udp",
+		zones, err = authority.MakeZones(files)
+		if err != nil {
+			fmt.Println("Unable to load local zones:", err)
+			return
+		}
+		if len(files) > 0 {
+			fmt.Printf("Loaded %d local zones\n", zones.Count())
+		}
+
+		if conf.Local.Empty.Enabled {
+			fmt.Printf("Serving %d empty zones\n", zones.ServeEmpty(conf.Local.Empty.Exclude))
+		}
+
+		zones.SetOnReload(messageCache.Clear)
+		dnsHandler.SetZones(zones)
+
+		if conf.Local.Check > 0 {
+			go zones.CheckEvery(time.Duration(conf.Local.Check) * time.Second)
+		}
 	}
 
-	server.Handler = dns.HandlerFunc(func(writer dns.ResponseWriter, msg *dns.Msg) {
-		defer writer.Close()
+	if len(conf.Hosts.Files) > 0 {
+		hostsFiles, err := hosts.MakeHosts(conf.Hosts.Files, conf.Hosts.Ttl)
+		if err != nil {
+			fmt.Println("Unable to load hosts files:", err)
+			return
+		}
+		fmt.Printf("Loaded hosts files with %d names\n", hostsFiles.Entries())
+
+		hostsFiles.SetOnReload(messageCache.Clear)
+		dnsHandler.SetHosts(hostsFiles)
 
-		if msg.Opcode != dns.OpcodeQuery {
-			msg.Rcode = dns.RcodeNotImplemented
-			_ = writer.WriteMsg(msg)
+		if conf.Hosts.Check > 0 {
+			go hostsFiles.CheckEvery(time.Duration(conf.Hosts.Check) * time.Second)
+		}
+	}
 
+	if conf.QueryLog != "" {
+		queryLog, err := MakeQueryLog(conf.QueryLog)
+		if err != nil {
+			fmt.Println("Unable to open the query log:", err)
 			return
 		}
+		dnsHandler.SetQueryLog(queryLog)
+	}
 
-		res, err := dnsHandler.Do(&msg.Question[0])
-		msg.RecursionAvailable = true
+	invalidator := MakeInvalidator(conf.Redis.NodeId, redisPool, localCache, messageCache)
+	go invalidator.Listen()
 
-		if res != nil {
-			msg.Authoritative = res.Authoritative
-			msg.AuthenticatedData = res.AuthenticatedData
-			msg.Ns = res.Ns
-			msg.Extra = res.Extra
-			msg.Rcode = dns.RcodeSuccess
+	var updater *Updater
+	if len(conf.Update.Keys) > 0 {
+		if zones == nil {
+			fmt.Println("Updates need local zones to update")
+			return
 		}
 
-		if err == nil {
-			msg.Response = true
-			msg.Answer = res.Answer
-		} else {
-			msg.Response = false
-			msg.Rcode = dns.RcodeNameError
+		updater = MakeUpdater(zones, conf.Update.Keys, invalidator)
+		dnsHandler.SetUpdater(updater)
+	}
+
+	if conf.Persistence.Path != "" {
+		loadSnapshot(localCache, conf.Persistence.Path)
+
+		if conf.Persistence.Interval > 0 {
+			go snapshotEvery(localCache, conf.Persistence.Path, time.Duration(conf.Persistence.Interval)*time.Second)
 		}
+	}
 
-		_ = writer.WriteMsg(msg)
-	})
+	if conf.Http.Listen != "" {
+		mux := MakeStatusMux(redisPool, dnsPool, localCache, blocks, conf.Redis.Required)
+		if conf.Http.Token != "" {
+			admin := MakeAdminHandler(conf.Http.Token, localCache, messageCache, invalidator)
+			admin.ManageUpstreams(dnsPool, conf, *configPath)
+			mux.Handle("/admin/", admin)
+		}
 
-	fmt.Println("Listening on", port)
-	err = server.ListenAndServe()
+		go func() {
+			fmt.Println("Serving status on", conf.Http.Listen)
+			err := http.ListenAndServe(conf.Http.Listen, mux)
+			fmt.Println("Status server stopped:", err)
+		}()
+	}
 
-	if err != nil {
+	// Truncated answers, like those of tcp-only policies, are asked again over TCP
+	var servers []*dns.Server
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr: conf.Listen,
+			Net:  network,
+		}
+
+		server.Handler = dnsHandler
+		if updater != nil {
+			server.TsigSecret = updater.Secrets()
+			server.MsgAcceptFunc = acceptUpdates
+		}
+
+		servers = append(servers, server)
+	}
+
+	fmt.Println("Listening on", conf.Listen)
+	serverErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			serverErr <- server.ListenAndServe()
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err = <-serverErr:
 		fmt.Println(err)
+	case sig := <-signals:
+		fmt.Println("Shutting down on", sig)
+	}
+
+	for _, server := range servers {
+		_ = server.Shutdown()
+	}
+
+	if conf.Persistence.Path != "" {
+		saveSnapshot(localCache, conf.Persistence.Path)
 	}
 }
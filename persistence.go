@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Bob620/baka-dns/cache"
+)
+
+func loadSnapshot(localCache *cache.Cache, path string) {
+	loaded, err := localCache.Load(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Ignoring cache snapshot %s: %s\n", path, err)
+		return
+	}
+
+	fmt.Printf("Loaded %d record sets from cache snapshot %s\n", loaded, path)
+}
+
+func saveSnapshot(localCache *cache.Cache, path string) {
+	saved, err := localCache.Save(path)
+	if err != nil {
+		fmt.Printf("Unable to save cache snapshot %s: %s\n", path, err)
+		return
+	}
+
+	fmt.Printf("Saved %d record sets to cache snapshot %s\n", saved, path)
+}
+
+func snapshotEvery(localCache *cache.Cache, path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		saveSnapshot(localCache, path)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLog appends a CSV line for every response from a single writer goroutine, lines are dropped rather than
+// holding up responses when the writer falls behind
+type QueryLog struct {
+	lines   chan []string
+	dropped int64
+}
+
+func MakeQueryLog(path string) (*QueryLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	writer := csv.NewWriter(file)
+	if info.Size() == 0 {
+		_ = writer.Write([]string{"time", "client", "name", "type", "rcode", "answers", "policy"})
+	}
+
+	queryLog := &QueryLog{lines: make(chan []string, 1024)}
+
+	go func() {
+		for line := range queryLog.lines {
+			_ = writer.Write(line)
+
+			if len(queryLog.lines) == 0 {
+				writer.Flush()
+			}
+		}
+	}()
+
+	return queryLog, nil
+}
+
+func (queryLog *QueryLog) Log(client string, question *dns.Question, rcode string, answers int, policy string) {
+	if queryLog == nil {
+		return
+	}
+
+	line := []string{
+		time.Now().Format(time.RFC3339Nano),
+		client,
+		question.Name,
+		dns.TypeToString[question.Qtype],
+		rcode,
+		strconv.Itoa(answers),
+		policy,
+	}
+
+	select {
+	case queryLog.lines <- line:
+	default:
+		atomic.AddInt64(&queryLog.dropped, 1)
+	}
+}
+
+func (queryLog *QueryLog) GetDropped() int64 {
+	return atomic.LoadInt64(&queryLog.dropped)
+}
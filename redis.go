@@ -1,73 +1,462 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Bob620/baka-dns/config"
+	"github.com/Bob620/baka-dns/statistics"
 	"github.com/mediocregopher/radix/v3"
+	"github.com/miekg/dns"
 )
 
+const (
+	// Consecutive failures before the circuit breaker opens
+	redisMaxFailures = 3
+	redisMinBackoff  = 100 * time.Millisecond
+	redisMaxBackoff  = 30 * time.Second
+	redisPingEvery   = 5 * time.Second
+)
+
+var errRedisDown = errors.New("redis is down, unable to query")
+
 type RedisResponse struct {
 	data string
 	err  error
 }
 
+// RedisPool keeps a connection pool to redis, after repeated failures the circuit breaker opens so commands fail
+// straight away while a background loop reconnects with exponential backoff
 type RedisPool struct {
-	pool  *radix.Pool
-	basis string
+	pool       radix.Client
+	conf       config.Redis
+	basis      string
+	tlsConfig  *tls.Config
+	failures   int
+	mutex      *sync.RWMutex
+	statistics *statistics.Redis
 }
 
-// Setup a custom redis client that timesout really quickly (default 1sec)
-func quickTimeoutRedis(network, addr string) (radix.Conn, error) {
-	return radix.Dial(network, addr,
-		radix.DialTimeout(100*time.Millisecond),
-	)
+// TLS settings for redis, nil when TLS is off
+func redisTLS(conf config.RedisTLS) (*tls.Config, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: conf.ServerName}
+
+	if conf.CA != "" {
+		ca, err := ioutil.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CA)
+		}
+	}
+
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
-func MakeRedisPool(addr, basis string) (*RedisPool, error) {
-	// Try to open redis redisPool
-	redisPool, err := radix.NewPool("tcp", addr, 10, radix.PoolConnFunc(quickTimeoutRedis))
+// Make a pool that is always usable, when redis can't be reached it starts out down and keeps trying to reconnect.
+// The pool is only nil when the settings are unusable.
+// Without an address or sentinel master there is no shared tier and the pool is nil
+func MakeRedisPool(conf config.Redis) (*RedisPool, error) {
+	if conf.Address == "" && conf.Sentinel.Master == "" {
+		return nil, nil
+	}
 
+	tlsConfig, err := redisTLS(conf.Tls)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RedisPool{redisPool, basis}, err
+	pool := &RedisPool{
+		conf:       conf,
+		basis:      conf.Basis,
+		tlsConfig:  tlsConfig,
+		mutex:      &sync.RWMutex{},
+		statistics: statistics.MakeRedis(),
+	}
+
+	redisPool, err := pool.connect()
+	if err != nil {
+		go pool.reconnect()
+	} else {
+		pool.pool = redisPool
+		pool.statistics.SetUp(true)
+	}
+
+	go pool.healthCheck()
+	return pool, err
+}
+
+// Options shared by connections to redis and to sentinels, these time out really quickly (default 1sec)
+func (pool *RedisPool) dialOpts(username, password string) []radix.DialOpt {
+	opts := []radix.DialOpt{radix.DialTimeout(100 * time.Millisecond)}
+
+	if username != "" {
+		opts = append(opts, radix.DialAuthUser(username, password))
+	} else if password != "" {
+		opts = append(opts, radix.DialAuthPass(password))
+	}
+
+	if pool.tlsConfig != nil {
+		opts = append(opts, radix.DialUseTLS(pool.tlsConfig))
+	}
+
+	return opts
+}
+
+func (pool *RedisPool) dial(network, addr string) (radix.Conn, error) {
+	opts := pool.dialOpts(pool.conf.Username, pool.conf.Password)
+	if pool.conf.Db != 0 {
+		opts = append(opts, radix.DialSelectDB(pool.conf.Db))
+	}
+
+	return radix.Dial(network, addr, opts...)
+}
+
+func (pool *RedisPool) dialSentinel(network, addr string) (radix.Conn, error) {
+	return radix.Dial(network, addr, pool.dialOpts(pool.conf.Sentinel.Username, pool.conf.Sentinel.Password)...)
+}
+
+func (pool *RedisPool) makePool(network, addr string) (radix.Client, error) {
+	return radix.NewPool(network, addr, 10, radix.PoolConnFunc(pool.dial))
+}
+
+// Connect straight to redis, or to the master the sentinels point at which is followed through failovers
+func (pool *RedisPool) connect() (radix.Client, error) {
+	var redisPool radix.Client
+	var err error
+
+	if pool.conf.Sentinel.Master != "" {
+		redisPool, err = radix.NewSentinel(pool.conf.Sentinel.Master, pool.conf.Sentinel.Addresses,
+			radix.SentinelConnFunc(pool.dialSentinel),
+			radix.SentinelPoolFunc(pool.makePool),
+		)
+	} else {
+		redisPool, err = pool.makePool("tcp", pool.conf.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := redisPool.Do(radix.Cmd(nil, "PING")); err != nil {
+		_ = redisPool.Close()
+		return nil, err
+	}
+
+	return redisPool, nil
+}
+
+// Address of the current master, asking each sentinel in turn when sentinels are used
+func (pool *RedisPool) primary() (string, error) {
+	if pool.conf.Sentinel.Master == "" {
+		return pool.conf.Address, nil
+	}
+
+	err := errors.New("no sentinels configured")
+	for _, sentinel := range pool.conf.Sentinel.Addresses {
+		var conn radix.Conn
+		if conn, err = pool.dialSentinel("tcp", sentinel); err != nil {
+			continue
+		}
+
+		var master []string
+		err = conn.Do(radix.Cmd(&master, "SENTINEL", "get-master-addr-by-name", pool.conf.Sentinel.Master))
+		_ = conn.Close()
+
+		if err == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+		if err == nil {
+			err = fmt.Errorf("sentinel %s doesn't know master %s", sentinel, pool.conf.Sentinel.Master)
+		}
+	}
+
+	return "", err
+}
+
+// Dial the current master for subscriptions, which outlive any one connection
+func (pool *RedisPool) dialPrimary(network, _ string) (radix.Conn, error) {
+	addr, err := pool.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	return pool.dial(network, addr)
+}
+
+// Retry with exponential backoff until redis answers again, then close the circuit breaker
+func (pool *RedisPool) reconnect() {
+	backoff := redisMinBackoff
+
+	for {
+		time.Sleep(backoff)
+
+		redisPool, err := pool.connect()
+		if err == nil {
+			pool.mutex.Lock()
+			pool.pool = redisPool
+			pool.failures = 0
+			pool.mutex.Unlock()
+
+			pool.statistics.SetUp(true)
+			pool.statistics.Reconnect()
+			fmt.Println("Reconnected to redis")
+			return
+		}
+
+		backoff *= 2
+		if backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// Count the outcome of a command, opening the circuit breaker after too many failures in a row
+func (pool *RedisPool) outcome(redisPool radix.Client, err error) {
+	if err == nil {
+		pool.mutex.Lock()
+		pool.failures = 0
+		pool.mutex.Unlock()
+		return
+	}
+
+	pool.statistics.Failure()
+
+	pool.mutex.Lock()
+	pool.failures++
+	// Only the first command to see the limit on this pool trips the breaker
+	if pool.failures < redisMaxFailures || pool.pool != redisPool {
+		pool.mutex.Unlock()
+		return
+	}
+	pool.pool = nil
+	pool.mutex.Unlock()
+
+	// Redis is dead, abandon ship until it comes back
+	_ = redisPool.Close()
+	pool.statistics.SetUp(false)
+	pool.statistics.Trip()
+	fmt.Println("Lost redis, reconnecting:", err)
+
+	go pool.reconnect()
+}
+
+func (pool *RedisPool) healthCheck() {
+	for range time.Tick(redisPingEvery) {
+		pool.mutex.RLock()
+		redisPool := pool.pool
+		pool.mutex.RUnlock()
+
+		if redisPool != nil {
+			pool.outcome(redisPool, redisPool.Do(radix.Cmd(nil, "PING")))
+		}
+	}
+}
+
+func (pool *RedisPool) Healthy() bool {
+	return pool.statistics.IsUp()
+}
+
+func (pool *RedisPool) Statistics() *statistics.Redis {
+	return pool.statistics
 }
 
-func (pool RedisPool) FlatCmd(command, key string, arguments []string) <-chan RedisResponse {
-	redisResponse := make(chan RedisResponse)
+func (pool *RedisPool) FlatCmd(command, key string, arguments []string) <-chan RedisResponse {
+	redisResponse := make(chan RedisResponse, 1)
+
+	pool.mutex.RLock()
+	redisPool := pool.pool
+	pool.mutex.RUnlock()
 
 	// Check for redis and then query the cache
-	if pool.pool != nil {
-		// query redis asynchronously and close the redisPool on the change redis can't be properly contacted
+	if redisPool != nil {
+		pool.statistics.Command()
+
+		// query redis asynchronously and count failures towards the circuit breaker
 		go func(response chan<- RedisResponse, command, key string, arguments []string) {
 			redisData := ""
-			err := pool.pool.Do(radix.FlatCmd(&redisData, command, key, arguments))
+			err := redisPool.Do(radix.FlatCmd(&redisData, command, key, arguments))
 			response <- RedisResponse{redisData, err}
 
-			if err != nil {
-				_ = pool.pool.Close()
-				// Redis is dead, abandon ship!
-				pool.pool = nil
-			}
+			pool.outcome(redisPool, err)
 		}(redisResponse, command, key, arguments)
 	} else {
-		redisResponse <- RedisResponse{"", errors.New("redis is down, unable to query")}
+		redisResponse <- RedisResponse{"", errRedisDown}
 	}
 
 	return redisResponse
 }
 
-func (pool RedisPool) Get(key string) <-chan RedisResponse {
+func (pool *RedisPool) Get(key string) <-chan RedisResponse {
 	return pool.FlatCmd("GET", fmt.Sprintf("%s:%s", pool.basis, key), []string{})
 }
 
-func (pool RedisPool) Set(key, value string) <-chan RedisResponse {
+func (pool *RedisPool) Set(key, value string) <-chan RedisResponse {
 	return pool.FlatCmd("SET", fmt.Sprintf("%s:%s", pool.basis, key), []string{value})
 }
 
-func (pool RedisPool) SetEx(key, value string, ttl uint32) <-chan RedisResponse {
+func (pool *RedisPool) SetEx(key, value string, ttl uint32) <-chan RedisResponse {
 	return pool.FlatCmd("SETEX", fmt.Sprintf("%s:%s", pool.basis, key), []string{fmt.Sprintf("%d", ttl), value})
 }
+
+func (pool *RedisPool) Publish(channel, message string) <-chan RedisResponse {
+	return pool.FlatCmd("PUBLISH", fmt.Sprintf("%s:%s", pool.basis, channel), []string{message})
+}
+
+// Call handle with every message published on the channel, subscribing in the background and resubscribing whenever
+// the connection is lost
+func (pool *RedisPool) Subscribe(channel string, handle func(string)) {
+	pubSub := radix.PersistentPubSub("tcp", pool.conf.Address, pool.dialPrimary)
+
+	messages := make(chan radix.PubSubMessage, 16)
+	if err := pubSub.Subscribe(messages, fmt.Sprintf("%s:%s", pool.basis, channel)); err != nil {
+		fmt.Println("Unable to subscribe to redis:", err)
+		_ = pubSub.Close()
+		return
+	}
+
+	for message := range messages {
+		handle(string(message.Message))
+	}
+}
+
+// Escape the characters redis treats as a glob pattern
+func globEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(text)
+}
+
+// Delete every key under the basis matching the glob pattern, returning how many were deleted
+func (pool *RedisPool) DeleteMatching(pattern string) (int, error) {
+	return pool.deleteScanned(pattern, func(string) bool { return true })
+}
+
+// Delete every key under the basis starting with any of the prefixes in a single scan, returning how many were deleted
+func (pool *RedisPool) DeletePrefixed(prefixes []string) (int, error) {
+	return pool.deleteScanned("*", func(key string) bool {
+		key = strings.TrimPrefix(key, pool.basis+":")
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Scan the keys under the basis matching the glob pattern, deleting the ones delete is true for
+func (pool *RedisPool) deleteScanned(pattern string, delete func(string) bool) (int, error) {
+	pool.mutex.RLock()
+	redisPool := pool.pool
+	pool.mutex.RUnlock()
+
+	if redisPool == nil {
+		return 0, errRedisDown
+	}
+
+	scanner := radix.NewScanner(redisPool, radix.ScanOpts{
+		Command: "SCAN",
+		Pattern: fmt.Sprintf("%s:%s", globEscape(pool.basis), pattern),
+		Count:   100,
+	})
+
+	deleted := 0
+	var key string
+	for scanner.Next(&key) {
+		if !delete(key) {
+			continue
+		}
+		if err := redisPool.Do(radix.Cmd(nil, "DEL", key)); err != nil {
+			pool.outcome(redisPool, err)
+			_ = scanner.Close()
+			return deleted, err
+		}
+		deleted++
+	}
+
+	err := scanner.Close()
+	pool.outcome(redisPool, err)
+	return deleted, err
+}
+
+// Responses are stored as the unix time they were stored at followed by the packed message, so ttls can be counted down.
+// Waits at most the configured timeout, and not at all while the circuit breaker is open
+func (pool *RedisPool) GetMsg(key string) *dns.Msg {
+	pool.mutex.RLock()
+	up := pool.pool != nil
+	pool.mutex.RUnlock()
+
+	if !up {
+		return nil
+	}
+
+	select {
+	case res := <-pool.Get(key):
+		if res.err != nil || len(res.data) < 8 {
+			return nil
+		}
+
+		stored := time.Unix(int64(binary.BigEndian.Uint64([]byte(res.data[:8]))), 0)
+		msg := new(dns.Msg)
+		if err := msg.Unpack([]byte(res.data[8:])); err != nil {
+			return nil
+		}
+
+		elapsed := uint32(time.Since(stored) / time.Second)
+		for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+			for _, record := range section {
+				if record.Header().Ttl <= elapsed {
+					return nil
+				}
+				record.Header().Ttl -= elapsed
+			}
+		}
+
+		return msg
+	case <-time.After(time.Duration(pool.conf.Timeout) * time.Millisecond):
+		return nil
+	}
+}
+
+// Store a response until its shortest ttl runs out
+func (pool *RedisPool) SetMsg(key string, msg *dns.Msg) {
+	var ttl uint32
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, record := range section {
+			if ttl == 0 || record.Header().Ttl < ttl {
+				ttl = record.Header().Ttl
+			}
+		}
+	}
+
+	wire, err := msg.Pack()
+	if err != nil || ttl == 0 {
+		return
+	}
+
+	value := make([]byte, 8, 8+len(wire))
+	binary.BigEndian.PutUint64(value, uint64(time.Now().Unix()))
+
+	pool.SetEx(key, string(append(value, wire...)), ttl)
+}
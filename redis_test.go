@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bob620/baka-dns/cache"
+	"github.com/Bob620/baka-dns/config"
+	"github.com/Bob620/baka-dns/upstream/pool"
+)
+
+// Replies of the redis stand-in, anything else is sent as a bulk string or an array of them
+type (
+	respSimple string
+	respError  string
+)
+
+// In-process stand-in for redis that speaks enough RESP for the pool. Its connections can be cut and it can listen
+// again on the same address, the keys it holds survive both.
+type redisStandIn struct {
+	t        *testing.T
+	addr     string
+	listener net.Listener
+	// Serve TLS when set
+	tlsConfig *tls.Config
+	conns     map[net.Conn]bool
+	data      map[string]string
+	// Handlers for commands the stand-in doesn't know itself, by upper cased command name
+	handlers map[string]func(args []string) interface{}
+	mutex    *sync.Mutex
+}
+
+func startRedisStandIn(t *testing.T) *redisStandIn {
+	return startTLSRedisStandIn(t, nil)
+}
+
+func startTLSRedisStandIn(t *testing.T, tlsConfig *tls.Config) *redisStandIn {
+	standIn := &redisStandIn{
+		t:         t,
+		addr:      "127.0.0.1:0",
+		tlsConfig: tlsConfig,
+		conns:     map[net.Conn]bool{},
+		data:      map[string]string{},
+		handlers:  map[string]func(args []string) interface{}{},
+		mutex:     &sync.Mutex{},
+	}
+	standIn.listen()
+
+	return standIn
+}
+
+func (standIn *redisStandIn) listen() {
+	listener, err := net.Listen("tcp", standIn.addr)
+	if err != nil {
+		standIn.t.Fatal(err)
+	}
+	if standIn.tlsConfig != nil {
+		listener = tls.NewListener(listener, standIn.tlsConfig)
+	}
+
+	standIn.mutex.Lock()
+	standIn.listener = listener
+	standIn.addr = listener.Addr().String()
+	standIn.mutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go standIn.serve(conn)
+		}
+	}()
+}
+
+// Stop listening and cut every connection, like redis going away
+func (standIn *redisStandIn) stop() {
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+
+	_ = standIn.listener.Close()
+	for conn := range standIn.conns {
+		_ = conn.Close()
+	}
+	standIn.conns = map[net.Conn]bool{}
+}
+
+func (standIn *redisStandIn) handle(command string, handler func(args []string) interface{}) {
+	standIn.mutex.Lock()
+	standIn.handlers[command] = handler
+	standIn.mutex.Unlock()
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:length])
+	}
+
+	return args, nil
+}
+
+func writeReply(writer *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		_, _ = writer.WriteString("$-1\r\n")
+	case respSimple:
+		_, _ = fmt.Fprintf(writer, "+%s\r\n", reply)
+	case respError:
+		_, _ = fmt.Fprintf(writer, "-%s\r\n", reply)
+	case int:
+		_, _ = fmt.Fprintf(writer, ":%d\r\n", reply)
+	case string:
+		_, _ = fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(reply), reply)
+	case []string:
+		_, _ = fmt.Fprintf(writer, "*%d\r\n", len(reply))
+		for _, element := range reply {
+			writeReply(writer, element)
+		}
+	case []interface{}:
+		_, _ = fmt.Fprintf(writer, "*%d\r\n", len(reply))
+		for _, element := range reply {
+			writeReply(writer, element)
+		}
+	}
+}
+
+func (standIn *redisStandIn) serve(conn net.Conn) {
+	standIn.mutex.Lock()
+	standIn.conns[conn] = true
+	standIn.mutex.Unlock()
+
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil || len(args) == 0 {
+			return
+		}
+
+		writeReply(writer, standIn.reply(args))
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (standIn *redisStandIn) reply(args []string) interface{} {
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+
+	command := strings.ToUpper(args[0])
+	if handler := standIn.handlers[command]; handler != nil {
+		return handler(args[1:])
+	}
+
+	switch {
+	case command == "PING":
+		return respSimple("PONG")
+	case command == "GET" && len(args) == 2:
+		if value, ok := standIn.data[args[1]]; ok {
+			return value
+		}
+		return nil
+	case command == "SET" && len(args) == 3:
+		standIn.data[args[1]] = args[2]
+		return respSimple("OK")
+	case command == "SETEX" && len(args) == 4:
+		standIn.data[args[1]] = args[3]
+		return respSimple("OK")
+	case command == "PUBLISH" && len(args) == 3:
+		return 0
+	}
+
+	return respError("ERR unknown command " + command)
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+	}
+}
+
+func TestRedisPoolReconnects(t *testing.T) {
+	standIn := startRedisStandIn(t)
+	defer standIn.stop()
+
+	redisPool, err := MakeRedisPool(config.Redis{Address: standIn.addr, Basis: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-redisPool.Set("name", "value"); res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// Commands fail until the circuit breaker opens, then they fail without reaching redis
+	standIn.stop()
+	waitFor(t, "the circuit breaker to open", func() bool {
+		<-redisPool.Get("name")
+		return !redisPool.Healthy()
+	})
+
+	stats := redisPool.Statistics()
+	if stats.GetTrips() != 1 || stats.GetFailures() < redisMaxFailures {
+		t.Errorf("%d trips and %d failures after losing redis", stats.GetTrips(), stats.GetFailures())
+	}
+
+	commands := stats.GetCommands()
+	if res := <-redisPool.Get("name"); res.err != errRedisDown {
+		t.Errorf("got %v from an open circuit breaker", res.err)
+	}
+	if stats.GetCommands() != commands {
+		t.Error("command sent to redis with the circuit breaker open")
+	}
+
+	standIn.listen()
+	waitFor(t, "the pool to reconnect", redisPool.Healthy)
+
+	if stats.GetReconnects() != 1 {
+		t.Errorf("%d reconnects", stats.GetReconnects())
+	}
+	if res := <-redisPool.Get("name"); res.err != nil || res.data != "value" {
+		t.Errorf("got %q, %v after reconnecting", res.data, res.err)
+	}
+}
+
+func TestRedisPoolStartsDown(t *testing.T) {
+	standIn := startRedisStandIn(t)
+	standIn.stop()
+
+	redisPool, err := MakeRedisPool(config.Redis{Address: standIn.addr, Basis: "test", Timeout: 10000})
+	if err == nil || redisPool == nil {
+		t.Fatalf("got %v, %v for a pool to redis that is down", redisPool, err)
+	}
+	if redisPool.Healthy() {
+		t.Error("pool to redis that is down is healthy")
+	}
+	if res := <-redisPool.Get("name"); res.err != errRedisDown {
+		t.Errorf("got %v from a pool to redis that is down", res.err)
+	}
+
+	started := time.Now()
+	if msg := redisPool.GetMsg("name"); msg != nil || time.Since(started) > time.Second {
+		t.Errorf("got %v after %s from a pool to redis that is down", msg, time.Since(started))
+	}
+
+	standIn.listen()
+	defer standIn.stop()
+	waitFor(t, "the pool to connect", redisPool.Healthy)
+}
+
+func TestRedisOff(t *testing.T) {
+	redisPool, err := MakeRedisPool(config.Redis{Basis: "test"})
+	if redisPool != nil || err != nil {
+		t.Fatalf("got %v, %v without an address", redisPool, err)
+	}
+
+	servers := []pool.Server{{Name: "stand-in", Address: "127.0.0.1", Port: "53"}}
+	dnsPool := pool.MakePool(&servers, &servers, &sync.WaitGroup{}, time.Second, 1)
+	mux := MakeStatusMux(redisPool, dnsPool, cache.MakeCache(10, 1), nil, false)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := recorder.Body.String(); strings.Contains(body, "baka_dns_redis") {
+		t.Errorf("redis metrics without redis: %q", body)
+	}
+
+	localCache := cache.MakeCache(10, 1)
+	invalidator := MakeInvalidator("node", redisPool, localCache, cache.MakeMessageCache(10, localCache.Statistics()))
+	if _, err := invalidator.Flush(FlushAll, ""); err != nil {
+		t.Errorf("flush without redis: %v", err)
+	}
+}
+
+func TestRedisStatus(t *testing.T) {
+	standIn := startRedisStandIn(t)
+	defer standIn.stop()
+
+	redisPool, err := MakeRedisPool(config.Redis{Address: standIn.addr, Basis: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []pool.Server{{Name: "stand-in", Address: "127.0.0.1", Port: "53"}}
+	dnsPool := pool.MakePool(&servers, &servers, &sync.WaitGroup{}, time.Second, 1)
+	mux := MakeStatusMux(redisPool, dnsPool, cache.MakeCache(10, 1), nil, true)
+
+	get := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	<-redisPool.Get("name")
+	if code, body := get("/readyz"); code != http.StatusOK || !strings.Contains(body, "redis: true") {
+		t.Errorf("ready with redis up: %d %q", code, body)
+	}
+	if _, body := get("/metrics"); !strings.Contains(body, "baka_dns_redis_up 1\n") || !strings.Contains(body, "baka_dns_redis_commands_total 1\n") {
+		t.Errorf("metrics with redis up: %q", body)
+	}
+
+	standIn.stop()
+	waitFor(t, "the circuit breaker to open", func() bool {
+		<-redisPool.Get("name")
+		return !redisPool.Healthy()
+	})
+
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "redis: false") {
+		t.Errorf("ready with redis down: %d %q", code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("not live with redis down: %d", code)
+	}
+	if _, body := get("/metrics"); !strings.Contains(body, "baka_dns_redis_up 0\n") || !strings.Contains(body, "baka_dns_redis_trips_total 1\n") {
+		t.Errorf("metrics with redis down: %q", body)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	tests := []struct {
+		username, password string
+		auth               []string
+		ok                 bool
+	}{
+		{"", "", nil, true},
+		{"", "secret", []string{"secret"}, true},
+		{"dns", "secret", []string{"dns", "secret"}, true},
+		{"dns", "wrong", []string{"dns", "wrong"}, false},
+	}
+
+	for _, test := range tests {
+		standIn := startRedisStandIn(t)
+
+		var auth []string
+		standIn.handle("AUTH", func(args []string) interface{} {
+			auth = args
+			if args[len(args)-1] != "secret" {
+				return respError("WRONGPASS invalid username-password pair")
+			}
+			return respSimple("OK")
+		})
+
+		_, err := MakeRedisPool(config.Redis{Address: standIn.addr, Basis: "test", Username: test.username, Password: test.password})
+		standIn.mutex.Lock()
+		if !reflect.DeepEqual(auth, test.auth) {
+			t.Errorf("user %q password %q sent AUTH %q", test.username, test.password, auth)
+		}
+		standIn.mutex.Unlock()
+
+		if (err == nil) != test.ok {
+			t.Errorf("user %q password %q connected with %v", test.username, test.password, err)
+		}
+		standIn.stop()
+	}
+}
+
+func TestRedisSelect(t *testing.T) {
+	for _, db := range []int{0, 3} {
+		standIn := startRedisStandIn(t)
+
+		selected := ""
+		standIn.handle("SELECT", func(args []string) interface{} {
+			selected = args[0]
+			return respSimple("OK")
+		})
+
+		if _, err := MakeRedisPool(config.Redis{Address: standIn.addr, Basis: "test", Db: db}); err != nil {
+			t.Fatal(err)
+		}
+
+		standIn.mutex.Lock()
+		if want := map[int]string{0: "", 3: "3"}[db]; selected != want {
+			t.Errorf("db %d selected %q", db, selected)
+		}
+		standIn.mutex.Unlock()
+		standIn.stop()
+	}
+}
+
+// Write a CA and a client certificate it signed to the directory, returning the TLS settings of a server with a
+// certificate from the same CA that requires client certificates
+func writeTestCerts(t *testing.T, dir string) *tls.Config {
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "baka-dns test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "127.0.0.1"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	}
+
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+	clientCert, clientKey := issue(2, x509.ExtKeyUsageClientAuth)
+	for name, contents := range map[string][]byte{"ca.pem": caPem, "client.pem": clientCert, "client-key.pem": clientKey} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverCert, err := tls.X509KeyPair(issue(3, x509.ExtKeyUsageServerAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPem)
+
+	return &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+}
+
+func TestRedisTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baka-dns-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	standIn := startTLSRedisStandIn(t, writeTestCerts(t, dir))
+	defer standIn.stop()
+
+	conf := config.Redis{Address: standIn.addr, Basis: "test", Tls: config.RedisTLS{
+		Enabled: true,
+		CA:      filepath.Join(dir, "ca.pem"),
+		Cert:    filepath.Join(dir, "client.pem"),
+		Key:     filepath.Join(dir, "client-key.pem"),
+	}}
+
+	redisPool, err := MakeRedisPool(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-redisPool.Set("name", "value"); res.err != nil {
+		t.Error(res.err)
+	}
+
+	// The stand-in only takes connections with a client certificate from its CA
+	conf.Tls.Cert, conf.Tls.Key = "", ""
+	if _, err := MakeRedisPool(conf); err == nil {
+		t.Error("connected without a client certificate")
+	}
+
+	// And the pool only trusts the CA it is given
+	conf.Tls.CA = ""
+	if _, err := MakeRedisPool(conf); err == nil {
+		t.Error("connected to redis with a certificate from an unknown CA")
+	}
+
+	conf.Tls.CA = filepath.Join(dir, "missing.pem")
+	if redisPool, err := MakeRedisPool(conf); redisPool != nil || err == nil {
+		t.Error("made a pool with a CA that can't be read")
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	master := startRedisStandIn(t)
+	defer master.stop()
+	sentinel := startRedisStandIn(t)
+	defer sentinel.stop()
+
+	host, port, _ := net.SplitHostPort(master.addr)
+	var auth []string
+	sentinel.handle("AUTH", func(args []string) interface{} {
+		auth = args
+		return respSimple("OK")
+	})
+	sentinel.handle("SENTINEL", func(args []string) interface{} {
+		if len(args) != 2 || args[1] != "mymaster" {
+			return respError("ERR No such master with that name")
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "master":
+			return []string{"name", "mymaster", "ip", host, "port", port, "flags", "master"}
+		case "get-master-addr-by-name":
+			return []string{host, port}
+		case "slaves", "sentinels":
+			return []string{}
+		}
+		return respError("ERR unknown sentinel subcommand " + args[0])
+	})
+	sentinel.handle("SUBSCRIBE", func(args []string) interface{} {
+		return []interface{}{"subscribe", args[0], 1}
+	})
+
+	redisPool, err := MakeRedisPool(config.Redis{Basis: "test", Sentinel: config.RedisSentinel{
+		Master:    "mymaster",
+		Addresses: []string{sentinel.addr},
+		Password:  "sentinel-secret",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-redisPool.Set("name", "value"); res.err != nil {
+		t.Fatal(res.err)
+	}
+	master.mutex.Lock()
+	if master.data["test:name"] != "value" {
+		t.Error("set didn't reach the master the sentinel points at")
+	}
+	master.mutex.Unlock()
+
+	sentinel.mutex.Lock()
+	if !reflect.DeepEqual(auth, []string{"sentinel-secret"}) {
+		t.Errorf("sentinel got AUTH %q", auth)
+	}
+	sentinel.mutex.Unlock()
+
+	// Subscriptions dial the master themselves
+	if primary, err := redisPool.primary(); err != nil || primary != master.addr {
+		t.Errorf("primary is %q, %v rather than %s", primary, err, master.addr)
+	}
+
+	_, err = MakeRedisPool(config.Redis{Basis: "test", Sentinel: config.RedisSentinel{Master: "other", Addresses: []string{sentinel.addr}}})
+	if err == nil {
+		t.Error("connected to a master the sentinel doesn't know")
+	}
+}
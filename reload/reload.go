@@ -0,0 +1,64 @@
+package reload
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Watcher remembers when each file was last read so changes can be spotted, and calls back after every reload
+type Watcher struct {
+	modified map[string]time.Time
+	onReload func()
+	mutex    *sync.RWMutex
+}
+
+func MakeWatcher() *Watcher {
+	return &Watcher{modified: map[string]time.Time{}, mutex: &sync.RWMutex{}}
+}
+
+// Called after every successful reload, usually to drop answers made from the old data
+func (watcher *Watcher) SetOnReload(onReload func()) {
+	watcher.mutex.Lock()
+	watcher.onReload = onReload
+	watcher.mutex.Unlock()
+}
+
+// Call back after a reload, the callback is called without the lock held
+func (watcher *Watcher) Reloaded() {
+	watcher.mutex.RLock()
+	onReload := watcher.onReload
+	watcher.mutex.RUnlock()
+
+	if onReload != nil {
+		onReload()
+	}
+}
+
+// Remember the modification time the file had when it was read
+func (watcher *Watcher) Read(path string, modified time.Time) {
+	watcher.mutex.Lock()
+	watcher.modified[path] = modified
+	watcher.mutex.Unlock()
+}
+
+// Whether the file was modified since it was last read, files that can't be looked at count as unchanged
+func (watcher *Watcher) Changed(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	watcher.mutex.RLock()
+	modified, ok := watcher.modified[path]
+	watcher.mutex.RUnlock()
+
+	return !ok || !info.ModTime().Equal(modified)
+}
+
+// Call check every interval until the process exits
+func Every(interval time.Duration, check func()) {
+	for range time.Tick(interval) {
+		check()
+	}
+}
@@ -0,0 +1,55 @@
+package reload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baka-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := MakeWatcher()
+	if !watcher.Changed(path) {
+		t.Error("file that was never read is unchanged")
+	}
+	if watcher.Changed(filepath.Join(dir, "missing")) {
+		t.Error("missing file changed")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.Read(path, info.ModTime())
+	if watcher.Changed(path) {
+		t.Error("file changed right after it was read")
+	}
+
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !watcher.Changed(path) {
+		t.Error("modified file is unchanged")
+	}
+
+	reloads := 0
+	watcher.Reloaded()
+	watcher.SetOnReload(func() { reloads++ })
+	watcher.Reloaded()
+	if reloads != 1 {
+		t.Errorf("called back %d times for one reload", reloads)
+	}
+}
@@ -0,0 +1,159 @@
+package rpz
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Bob620/baka-dns/reload"
+)
+
+type ZoneFile struct {
+	Name string
+	Path string
+}
+
+// Policy holds the policy zones in order, the first zone with a match for a trigger wins
+type Policy struct {
+	files   []ZoneFile
+	zones   []*Zone
+	mutex   *sync.RWMutex
+	watcher *reload.Watcher
+}
+
+func MakePolicy(files []ZoneFile) (*Policy, error) {
+	policy := &Policy{files: files, mutex: &sync.RWMutex{}, watcher: reload.MakeWatcher()}
+	return policy, policy.Reload()
+}
+
+// Read every zone again, the old zones stay in place unless all of them load
+func (policy *Policy) Reload() error {
+	zones := make([]*Zone, len(policy.files))
+	for i, file := range policy.files {
+		zone, err := LoadZone(file.Name, file.Path)
+		if err != nil {
+			return err
+		}
+		zones[i] = zone
+	}
+
+	policy.mutex.Lock()
+	policy.zones = zones
+	policy.mutex.Unlock()
+
+	policy.watcher.Reloaded()
+	return nil
+}
+
+// Called after every successful reload
+func (policy *Policy) SetOnReload(onReload func()) {
+	policy.watcher.SetOnReload(onReload)
+}
+
+func (policy *Policy) ReloadEvery(interval time.Duration) {
+	reload.Every(interval, func() {
+		if err := policy.Reload(); err != nil {
+			fmt.Println("Unable to reload policy zones, keeping the old ones:", err)
+		}
+	})
+}
+
+func (policy *Policy) current() []*Zone {
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+
+	return policy.zones
+}
+
+// Zones in order up to the count
+func (policy *Policy) first(count int) []*Zone {
+	zones := policy.current()
+	if count < len(zones) {
+		return zones[:count]
+	}
+
+	return zones
+}
+
+func (policy *Policy) ClientIP(ip net.IP) *Rule {
+	for _, zone := range policy.current() {
+		if rule := matchIP(zone.clientIPs, ip); rule != nil {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// First rule for the client or the lower cased, fully qualified query name along with the number of zones before the
+// one it is from. Within a zone the client trigger is checked first. Without a rule the count is every zone.
+func (policy *Policy) Query(ip net.IP, name string) (*Rule, int) {
+	zones := policy.current()
+	for i, zone := range zones {
+		if rule := matchIP(zone.clientIPs, ip); rule != nil {
+			return rule, i
+		}
+		if rule := matchName(zone.qnames, zone.qnameWilds, name); rule != nil {
+			return rule, i
+		}
+	}
+
+	return nil, len(zones)
+}
+
+func (zone *Zone) hasQNames() bool {
+	return len(zone.qnames) > 0 || len(zone.qnameWilds) > 0
+}
+
+func (zone *Zone) hasNSDNames() bool {
+	return len(zone.nsdnames) > 0 || len(zone.nsdnameWilds) > 0
+}
+
+// Whether any of the first zones has triggers for answers, those have to be resolved before their rules are known. Query
+// name triggers count since they also match the names an answer's alias chain goes through.
+func (policy *Policy) HasResponseTriggers(zones int) bool {
+	for _, zone := range policy.first(zones) {
+		if zone.hasQNames() || len(zone.responseIPs) > 0 || zone.hasNSDNames() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// First rule in the first zones for the lower cased, fully qualified names an answer's alias chain goes through, its
+// addresses or the names of its name servers. Finding the name servers costs extra lookups so they are only asked for
+// when a zone has triggers for them.
+func (policy *Policy) Response(chain []string, ips []net.IP, nameServers func() []string, zones int) *Rule {
+	var names []string
+	found := false
+
+	for _, zone := range policy.first(zones) {
+		for _, name := range chain {
+			if rule := matchName(zone.qnames, zone.qnameWilds, name); rule != nil {
+				return rule
+			}
+		}
+
+		for _, ip := range ips {
+			if rule := matchIP(zone.responseIPs, ip); rule != nil {
+				return rule
+			}
+		}
+
+		if !zone.hasNSDNames() {
+			continue
+		}
+		if !found {
+			names, found = nameServers(), true
+		}
+		for _, name := range names {
+			if rule := matchName(zone.nsdnames, zone.nsdnameWilds, name); rule != nil {
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
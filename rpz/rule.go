@@ -0,0 +1,107 @@
+package rpz
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type Action int
+
+const (
+	Nxdomain Action = iota
+	Nodata
+	Passthru
+	Drop
+	TcpOnly
+	LocalData
+)
+
+var actionNames = map[Action]string{
+	Nxdomain:  "nxdomain",
+	Nodata:    "nodata",
+	Passthru:  "passthru",
+	Drop:      "drop",
+	TcpOnly:   "tcp-only",
+	LocalData: "local-data",
+}
+
+func (action Action) String() string {
+	return actionNames[action]
+}
+
+type Trigger string
+
+const (
+	ClientIP   Trigger = "client-ip"
+	QName      Trigger = "qname"
+	ResponseIP Trigger = "response-ip"
+	NSDName    Trigger = "nsdname"
+)
+
+// Rule is the policy for one trigger owner name in a policy zone
+type Rule struct {
+	Zone    string
+	Trigger Trigger
+	// Owner name of the rule inside the zone
+	Owner  string
+	Action Action
+	// Records of local data rules
+	Records []dns.RR
+	// SOA of the zone for the authority section of NXDOMAIN and NODATA answers
+	Soa *dns.SOA
+}
+
+func (rule *Rule) String() string {
+	return fmt.Sprintf("rpz %s %s %s %s", rule.Zone, rule.Trigger, rule.Owner, rule.Action)
+}
+
+// Local data for the name and type, owned by the name. Any CNAME is returned on its own so it can be followed.
+func (rule *Rule) Answer(name string, qtype uint16) []dns.RR {
+	var answer []dns.RR
+
+	for _, record := range rule.Records {
+		rrtype := record.Header().Rrtype
+		if rrtype == dns.TypeCNAME {
+			record = dns.Copy(record)
+			record.Header().Name = name
+			return []dns.RR{record}
+		}
+
+		if rrtype == qtype || qtype == dns.TypeANY {
+			record = dns.Copy(record)
+			record.Header().Name = name
+			answer = append(answer, record)
+		}
+	}
+
+	return answer
+}
+
+// Special CNAME targets of the actions besides local data
+func recordsAction(records []dns.RR) Action {
+	if len(records) != 1 {
+		return LocalData
+	}
+
+	cname, ok := records[0].(*dns.CNAME)
+	if !ok {
+		return LocalData
+	}
+
+	switch strings.ToLower(cname.Target) {
+	case ".":
+		return Nxdomain
+	case "*.":
+		return Nodata
+	case "rpz-passthru.":
+		return Passthru
+	case "rpz-drop.":
+		return Drop
+	case "rpz-tcp-only.":
+		return TcpOnly
+	}
+
+	return LocalData
+}
@@ -0,0 +1,207 @@
+package rpz
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type ipRule struct {
+	network *net.IPNet
+	rule    *Rule
+}
+
+// Zone is one policy zone, names are kept lower cased and fully qualified
+type Zone struct {
+	Name         string
+	soa          *dns.SOA
+	qnames       map[string]*Rule
+	qnameWilds   map[string]*Rule
+	nsdnames     map[string]*Rule
+	nsdnameWilds map[string]*Rule
+	responseIPs  []ipRule
+	clientIPs    []ipRule
+}
+
+// Address and prefix from the reversed labels of an IP trigger, 32.1.0.0.10 is 10.0.0.1/32 and 48.zz.db8.2001 is
+// 2001:db8::/48
+func parseIPTrigger(labels []string) (*net.IPNet, error) {
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("%s is not an ip trigger", strings.Join(labels, "."))
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad prefix length %s", labels[0])
+	}
+
+	parts := make([]string, len(labels)-1)
+	for i := range parts {
+		parts[i] = labels[len(labels)-1-i]
+	}
+
+	var address string
+	bits := 32
+	if len(parts) == 4 && !strings.Contains(strings.Join(parts, ""), "zz") {
+		address = strings.Join(parts, ".")
+	} else {
+		bits = 128
+		address = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(address, ":") {
+			address = ":" + address
+		}
+		if strings.HasSuffix(address, ":") {
+			address += ":"
+		}
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil || prefix < 0 || prefix > bits {
+		return nil, fmt.Errorf("bad ip trigger %s", strings.Join(labels, "."))
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// Read a policy zone from a master file, names in the file are relative to the zone name
+func LoadZone(name, path string) (*Zone, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zone := &Zone{
+		Name:         name,
+		qnames:       map[string]*Rule{},
+		qnameWilds:   map[string]*Rule{},
+		nsdnames:     map[string]*Rule{},
+		nsdnameWilds: map[string]*Rule{},
+	}
+
+	// Records are grouped by owner first since a rule can have several
+	owners := map[string][]dns.RR{}
+	var order []string
+
+	parser := dns.NewZoneParser(file, name, path)
+	for record, ok := parser.Next(); ok; record, ok = parser.Next() {
+		owner := strings.ToLower(record.Header().Name)
+
+		if owner == name {
+			if soa, ok := record.(*dns.SOA); ok {
+				zone.soa = soa
+			}
+			continue
+		}
+
+		if !dns.IsSubDomain(name, owner) {
+			return nil, fmt.Errorf("%s is outside of %s", owner, name)
+		}
+
+		relative := strings.TrimSuffix(owner, "."+name)
+		if owners[relative] == nil {
+			order = append(order, relative)
+		}
+		owners[relative] = append(owners[relative], record)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, relative := range order {
+		if err := zone.addRule(relative, owners[relative]); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return zone, nil
+}
+
+func (zone *Zone) addRule(relative string, records []dns.RR) error {
+	rule := &Rule{Zone: zone.Name, Owner: relative, Action: recordsAction(records), Records: records, Soa: zone.soa}
+	labels := dns.SplitDomainName(relative)
+	last := labels[len(labels)-1]
+
+	switch last {
+	case "rpz-ip", "rpz-client-ip":
+		network, err := parseIPTrigger(labels[:len(labels)-1])
+		if err != nil {
+			return err
+		}
+
+		if last == "rpz-ip" {
+			rule.Trigger = ResponseIP
+			zone.responseIPs = append(zone.responseIPs, ipRule{network, rule})
+		} else {
+			rule.Trigger = ClientIP
+			zone.clientIPs = append(zone.clientIPs, ipRule{network, rule})
+		}
+	case "rpz-nsdname":
+		rule.Trigger = NSDName
+		addName(zone.nsdnames, zone.nsdnameWilds, labels[:len(labels)-1], rule)
+	case "rpz-nsip":
+		// Nameserver address triggers are not supported
+	default:
+		rule.Trigger = QName
+		addName(zone.qnames, zone.qnameWilds, labels, rule)
+	}
+
+	return nil
+}
+
+func addName(names, wilds map[string]*Rule, labels []string, rule *Rule) {
+	if len(labels) > 1 && labels[0] == "*" {
+		wilds[dns.Fqdn(strings.Join(labels[1:], "."))] = rule
+		return
+	}
+
+	names[dns.Fqdn(strings.Join(labels, "."))] = rule
+}
+
+// Exact names win over wildcards, and the wildcard closest to the name wins over the rest
+func matchName(names, wilds map[string]*Rule, name string) *Rule {
+	if rule := names[name]; rule != nil {
+		return rule
+	}
+
+	if len(wilds) == 0 {
+		return nil
+	}
+
+	for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+		if rule := wilds[name[offset:]]; rule != nil {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Longest prefix containing the address wins
+func matchIP(rules []ipRule, ip net.IP) *Rule {
+	var best *Rule
+	bestSize := -1
+
+	for _, rule := range rules {
+		if !rule.network.Contains(ip) {
+			continue
+		}
+
+		if size, _ := rule.network.Mask.Size(); size > bestSize {
+			best = rule.rule
+			bestSize = size
+		}
+	}
+
+	return best
+}
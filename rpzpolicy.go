@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bob620/baka-dns/cache"
+	"github.com/Bob620/baka-dns/rpz"
+	"github.com/miekg/dns"
+)
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+
+	return nil
+}
+
+func isTCP(addr net.Addr) bool {
+	_, ok := addr.(*net.TCPAddr)
+	return ok
+}
+
+func answerIPs(answer []dns.RR) []net.IP {
+	var ips []net.IP
+	for _, record := range answer {
+		switch record := record.(type) {
+		case *dns.A:
+			ips = append(ips, record.A)
+		case *dns.AAAA:
+			ips = append(ips, record.AAAA)
+		}
+	}
+
+	return ips
+}
+
+// Names other than the question an answer's alias chain goes through, lower cased
+func chainNames(name string, answer []dns.RR) []string {
+	var names []string
+	seen := map[string]bool{strings.ToLower(name): true}
+
+	for _, record := range answer {
+		candidates := []string{record.Header().Name}
+		if cname, ok := record.(*dns.CNAME); ok {
+			candidates = append(candidates, cname.Target)
+		}
+
+		for _, candidate := range candidates {
+			if candidate = strings.ToLower(candidate); !seen[candidate] {
+				seen[candidate] = true
+				names = append(names, candidate)
+			}
+		}
+	}
+
+	return names
+}
+
+const (
+	// Names whose name servers are remembered before the whole cache is dropped
+	nameServerCacheSize = 10000
+	// How long a name without any name servers found is remembered
+	nameServerMissTtl = 60
+)
+
+type nameServerEntry struct {
+	servers []string
+	expires time.Time
+}
+
+// Name servers found for query names, kept for the shortest ttl of their NS records so the lookups up the tree aren't
+// repeated for every query while NSDNAME triggers are loaded
+type nameServerCache struct {
+	entries map[cache.Key]nameServerEntry
+	mutex   *sync.Mutex
+}
+
+func makeNameServerCache() *nameServerCache {
+	return &nameServerCache{entries: map[cache.Key]nameServerEntry{}, mutex: &sync.Mutex{}}
+}
+
+func (nsCache *nameServerCache) get(key cache.Key) ([]string, bool) {
+	nsCache.mutex.Lock()
+	defer nsCache.mutex.Unlock()
+
+	entry, ok := nsCache.entries[key]
+	if !ok || !entry.expires.After(time.Now()) {
+		return nil, false
+	}
+
+	return entry.servers, true
+}
+
+func (nsCache *nameServerCache) set(key cache.Key, servers []string, ttl uint32) {
+	nsCache.mutex.Lock()
+	defer nsCache.mutex.Unlock()
+
+	if len(nsCache.entries) >= nameServerCacheSize {
+		nsCache.entries = map[cache.Key]nameServerEntry{}
+	}
+
+	nsCache.entries[key] = nameServerEntry{servers: servers, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// Names of the servers for the closest zone holding the name, found by asking for NS records up the tree
+func (handler DnsHandler) nameServers(key cache.Key) []string {
+	if servers, ok := handler.nsCache.get(key); ok {
+		return servers
+	}
+
+	servers, ttl := handler.findNameServers(key)
+	handler.nsCache.set(key, servers, ttl)
+
+	return servers
+}
+
+// Name servers of the closest zone holding the name along with the shortest ttl of their NS records
+func (handler DnsHandler) findNameServers(key cache.Key) ([]string, uint32) {
+	name := string(key.Name)
+
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		zone := name[offset:]
+		question := &dns.Question{Name: zone, Qtype: dns.TypeNS, Qclass: uint16(key.Class)}
+
+		res, _, err := handler.resolve(question, key.WithName(zone))
+		if err != nil {
+			continue
+		}
+
+		var servers []string
+		var ttl uint32
+		for _, record := range res.Answer {
+			if ns, ok := record.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, zone) {
+				servers = append(servers, strings.ToLower(ns.Ns))
+				if ttl == 0 || ns.Hdr.Ttl < ttl {
+					ttl = ns.Hdr.Ttl
+				}
+			}
+		}
+
+		if len(servers) > 0 {
+			return servers, ttl
+		}
+	}
+
+	return nil, nameServerMissTtl
+}
+
+// Rule in the first zones triggered by the answer itself, through the names of its alias chain, its addresses or the
+// name servers of the name
+func (handler DnsHandler) responseRule(key cache.Key, res *dns.Msg, zones int) *rpz.Rule {
+	return handler.rpz.Response(chainNames(string(key.Name), res.Answer), answerIPs(res.Answer), func() []string { return handler.nameServers(key) }, zones)
+}
+
+// Answer a question as the rule says, a nil resolution means the query carries on as normal
+func (handler DnsHandler) applyRule(rule *rpz.Rule, question *dns.Question, key cache.Key, client net.Addr) (*Resolution, error) {
+	resolution := &Resolution{Msg: new(dns.Msg), Policy: rule.String()}
+
+	var soa []dns.RR
+	if rule.Soa != nil {
+		soa = []dns.RR{rule.Soa}
+	}
+
+	switch rule.Action {
+	case rpz.Passthru:
+		return nil, nil
+	case rpz.Drop:
+		resolution.Drop = true
+	case rpz.TcpOnly:
+		// Truncated answers send the client back over TCP, where the query goes through
+		if isTCP(client) {
+			return nil, nil
+		}
+		resolution.Msg.Truncated = true
+	case rpz.Nxdomain:
+		resolution.Msg.Rcode = dns.RcodeNameError
+		resolution.Msg.Ns = soa
+	case rpz.Nodata:
+		resolution.Msg.Ns = soa
+	case rpz.LocalData:
+		answer := rule.Answer(question.Name, question.Qtype)
+		resolution.Msg.Answer = answer
+
+		// Local CNAMEs are followed like any other alias
+		if len(answer) == 1 && answer[0].Header().Rrtype == dns.TypeCNAME && question.Qtype != dns.TypeCNAME {
+			target := answer[0].(*dns.CNAME).Target
+			res, _, err := handler.resolve(&dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}, key.WithName(target))
+			if err != nil {
+				return nil, err
+			}
+
+			resolution.Msg.Rcode = res.Rcode
+			resolution.Msg.Answer = append(answer, res.Answer...)
+			resolution.Msg.Ns = res.Ns
+		} else if len(answer) == 0 {
+			resolution.Msg.Ns = soa
+		}
+	}
+
+	return resolution, nil
+}
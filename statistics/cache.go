@@ -13,6 +13,14 @@ type Cache struct {
 	eviction        int64
 	requests        int64
 	tangentRequests int64
+	tangentHits     int64
+	prefetches      int64
+	prefetchHits    int64
+	prefetchSaved   int64
+	stale           int64
+	messageHits     int64
+	admissions      int64
+	rejections      int64
 	size            int64
 	maxSize         int64
 }
@@ -22,8 +30,9 @@ func MakeCache(maxSize int64) *Cache {
 	var timed func()
 
 	timed = func() {
-		fmt.Printf("\nMax Size:\t%d\nSize:\t\t%d\nHits:\t\t%d\nMisses:\t\t%d\nInserts:\t%d\nEvicts:\t\t%d\n\nRequests:\t%d\nTangets:\t%d\n\n",
-			cache.GetMax(), cache.GetSize(), cache.GetHits(), cache.GetMisses(), cache.GetInsertions(), cache.GetEvictions(), cache.GetRequests(), cache.GetTangentRequests(),
+		fmt.Printf("\nMax Size:\t%d\nSize:\t\t%d\nHits:\t\t%d\nMisses:\t\t%d\nInserts:\t%d\nEvicts:\t\t%d\nAdmits:\t\t%d\nRejects:\t%d\n\nRequests:\t%d\nTangets:\t%d\nTangent Hits:\t%d (%.1f%%)\n\nPrefetches:\t%d\nPrefetch Hits:\t%d\nSaved:\t\t%s\nStale:\t\t%d\nMessage Hits:\t%d\n\n",
+			cache.GetMax(), cache.GetSize(), cache.GetHits(), cache.GetMisses(), cache.GetInsertions(), cache.GetEvictions(), cache.GetAdmissions(), cache.GetRejections(), cache.GetRequests(), cache.GetTangentRequests(),
+			cache.GetTangentHits(), cache.GetTangentHitRate()*100, cache.GetPrefetches(), cache.GetPrefetchHits(), cache.GetPrefetchSaved(), cache.GetStale(), cache.GetMessageHits(),
 		)
 		time.AfterFunc(time.Second*5, timed)
 	}
@@ -40,6 +49,14 @@ func (cache *Cache) Reset() {
 	atomic.StoreInt64(&cache.size, 0)
 	atomic.StoreInt64(&cache.requests, 0)
 	atomic.StoreInt64(&cache.tangentRequests, 0)
+	atomic.StoreInt64(&cache.tangentHits, 0)
+	atomic.StoreInt64(&cache.prefetches, 0)
+	atomic.StoreInt64(&cache.prefetchHits, 0)
+	atomic.StoreInt64(&cache.prefetchSaved, 0)
+	atomic.StoreInt64(&cache.stale, 0)
+	atomic.StoreInt64(&cache.messageHits, 0)
+	atomic.StoreInt64(&cache.admissions, 0)
+	atomic.StoreInt64(&cache.rejections, 0)
 }
 
 func (cache *Cache) SetMax(newMax int64) {
@@ -54,6 +71,10 @@ func (cache *Cache) SetSize(newSize int64) {
 	atomic.StoreInt64(&cache.size, newSize)
 }
 
+func (cache *Cache) AddSize(delta int64) {
+	atomic.AddInt64(&cache.size, delta)
+}
+
 func (cache *Cache) GetSize() int64 {
 	return atomic.LoadInt64(&cache.size)
 }
@@ -105,3 +126,77 @@ func (cache *Cache) TangentRequest() {
 func (cache *Cache) GetTangentRequests() int64 {
 	return atomic.LoadInt64(&cache.tangentRequests)
 }
+
+func (cache *Cache) TangentHit() {
+	atomic.AddInt64(&cache.tangentHits, 1)
+}
+
+func (cache *Cache) GetTangentHits() int64 {
+	return atomic.LoadInt64(&cache.tangentHits)
+}
+
+// Fraction of tangent prefetches that were later used by a client query
+func (cache *Cache) GetTangentHitRate() float64 {
+	requests := cache.GetTangentRequests()
+	if requests == 0 {
+		return 0
+	}
+
+	return float64(cache.GetTangentHits()) / float64(requests)
+}
+
+func (cache *Cache) Prefetch() {
+	atomic.AddInt64(&cache.prefetches, 1)
+}
+
+func (cache *Cache) GetPrefetches() int64 {
+	return atomic.LoadInt64(&cache.prefetches)
+}
+
+// A client was answered by a prefetched record set, saving the upstream time spent refreshing it
+func (cache *Cache) PrefetchHit(saved time.Duration) {
+	atomic.AddInt64(&cache.prefetchHits, 1)
+	atomic.AddInt64(&cache.prefetchSaved, int64(saved))
+}
+
+func (cache *Cache) GetPrefetchHits() int64 {
+	return atomic.LoadInt64(&cache.prefetchHits)
+}
+
+func (cache *Cache) GetPrefetchSaved() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cache.prefetchSaved))
+}
+
+func (cache *Cache) Stale() {
+	atomic.AddInt64(&cache.stale, 1)
+}
+
+func (cache *Cache) GetStale() int64 {
+	return atomic.LoadInt64(&cache.stale)
+}
+
+func (cache *Cache) MessageHit() {
+	atomic.AddInt64(&cache.messageHits, 1)
+}
+
+func (cache *Cache) GetMessageHits() int64 {
+	return atomic.LoadInt64(&cache.messageHits)
+}
+
+// A domain left the admission window and was kept because it was more popular than the domain it replaced
+func (cache *Cache) Admit() {
+	atomic.AddInt64(&cache.admissions, 1)
+}
+
+func (cache *Cache) GetAdmissions() int64 {
+	return atomic.LoadInt64(&cache.admissions)
+}
+
+// A domain left the admission window and was dropped because it was less popular than the domain it would replace
+func (cache *Cache) Reject() {
+	atomic.AddInt64(&cache.rejections, 1)
+}
+
+func (cache *Cache) GetRejections() int64 {
+	return atomic.LoadInt64(&cache.rejections)
+}
@@ -0,0 +1,62 @@
+package statistics
+
+import (
+	"sync/atomic"
+)
+
+type Redis struct {
+	up         int32
+	commands   int64
+	failures   int64
+	trips      int64
+	reconnects int64
+}
+
+func MakeRedis() *Redis {
+	return &Redis{}
+}
+
+func (redis *Redis) SetUp(up bool) {
+	if up {
+		atomic.StoreInt32(&redis.up, 1)
+	} else {
+		atomic.StoreInt32(&redis.up, 0)
+	}
+}
+
+func (redis *Redis) IsUp() bool {
+	return atomic.LoadInt32(&redis.up) == 1
+}
+
+func (redis *Redis) Command() {
+	atomic.AddInt64(&redis.commands, 1)
+}
+
+func (redis *Redis) GetCommands() int64 {
+	return atomic.LoadInt64(&redis.commands)
+}
+
+func (redis *Redis) Failure() {
+	atomic.AddInt64(&redis.failures, 1)
+}
+
+func (redis *Redis) GetFailures() int64 {
+	return atomic.LoadInt64(&redis.failures)
+}
+
+// The circuit breaker opened and commands fail fast until redis is reconnected
+func (redis *Redis) Trip() {
+	atomic.AddInt64(&redis.trips, 1)
+}
+
+func (redis *Redis) GetTrips() int64 {
+	return atomic.LoadInt64(&redis.trips)
+}
+
+func (redis *Redis) Reconnect() {
+	atomic.AddInt64(&redis.reconnects, 1)
+}
+
+func (redis *Redis) GetReconnects() int64 {
+	return atomic.LoadInt64(&redis.reconnects)
+}
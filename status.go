@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Bob620/baka-dns/blocklist"
+	"github.com/Bob620/baka-dns/cache"
+	"github.com/Bob620/baka-dns/upstream/pool"
+)
+
+func boolGauge(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Liveness, readiness and metrics endpoints, readiness only depends on redis when it is required
+func MakeStatusMux(redisPool *RedisPool, dnsPool *pool.Pool, localCache *cache.Cache, blocks *blocklist.Blocklist, redisRequired bool) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = fmt.Fprintln(writer, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(writer http.ResponseWriter, request *http.Request) {
+		upstreams := dnsPool.NumUpstreams()
+		redisUp := redisPool != nil && redisPool.Healthy()
+
+		if upstreams < 1 || (redisRequired && !redisUp) {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_, _ = fmt.Fprintf(writer, "upstreams: %d\nredis: %t\n", upstreams, redisUp)
+	})
+
+	mux.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+		cacheStats := localCache.Statistics()
+
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = fmt.Fprintf(writer, "baka_dns_upstreams %d\n", dnsPool.NumUpstreams())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_size %d\n", cacheStats.GetSize())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_max_size %d\n", cacheStats.GetMax())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_hits_total %d\n", cacheStats.GetHits())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_misses_total %d\n", cacheStats.GetMisses())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_evictions_total %d\n", cacheStats.GetEvictions())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_stale_total %d\n", cacheStats.GetStale())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_message_hits_total %d\n", cacheStats.GetMessageHits())
+		_, _ = fmt.Fprintf(writer, "baka_dns_cache_prefetches_total %d\n", cacheStats.GetPrefetches())
+
+		if redisPool != nil {
+			redisStats := redisPool.Statistics()
+			_, _ = fmt.Fprintf(writer, "baka_dns_redis_up %d\n", boolGauge(redisStats.IsUp()))
+			_, _ = fmt.Fprintf(writer, "baka_dns_redis_commands_total %d\n", redisStats.GetCommands())
+			_, _ = fmt.Fprintf(writer, "baka_dns_redis_failures_total %d\n", redisStats.GetFailures())
+			_, _ = fmt.Fprintf(writer, "baka_dns_redis_trips_total %d\n", redisStats.GetTrips())
+			_, _ = fmt.Fprintf(writer, "baka_dns_redis_reconnects_total %d\n", redisStats.GetReconnects())
+		}
+
+		if blocks != nil {
+			blocked, allowed := blocks.Entries()
+			_, _ = fmt.Fprintf(writer, "baka_dns_blocklist_entries %d\n", blocked)
+			_, _ = fmt.Fprintf(writer, "baka_dns_allowlist_entries %d\n", allowed)
+			_, _ = fmt.Fprintf(writer, "baka_dns_blocked_total %d\n", blocks.GetBlocked())
+		}
+	})
+
+	return mux
+}
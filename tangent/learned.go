@@ -0,0 +1,143 @@
+package tangent
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	maxSessions = 10000
+	maxSuffixes = 10000
+)
+
+type suffixStats struct {
+	// Number of sessions opened by a type, and how often each other type followed inside the window
+	triggers map[uint16]int64
+	follows  map[uint16]map[uint16]int64
+}
+
+type session struct {
+	first   uint16
+	started time.Time
+	seen    map[uint16]bool
+}
+
+// Learned prefetches the types that have followed the queried type for the same suffix often enough
+type Learned struct {
+	window     time.Duration
+	threshold  float64
+	minSamples int64
+	suffixes   map[string]*suffixStats
+	sessions   map[string]*session
+	mutex      *sync.Mutex
+}
+
+func MakeLearned(window time.Duration, threshold float64, minSamples int64) *Learned {
+	return &Learned{
+		window:     window,
+		threshold:  threshold,
+		minSamples: minSamples,
+		suffixes:   map[string]*suffixStats{},
+		sessions:   map[string]*session{},
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// Registrable domain of the name from the public suffix list, so names under co.uk and the like don't share stats. Names
+// that are a public suffix themselves are their own group.
+func suffix(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		name = domain
+	}
+
+	return dns.Fqdn(name)
+}
+
+func (learned *Learned) stats(suffixName string) *suffixStats {
+	stats := learned.suffixes[suffixName]
+	if stats == nil && len(learned.suffixes) < maxSuffixes {
+		stats = &suffixStats{
+			triggers: map[uint16]int64{},
+			follows:  map[uint16]map[uint16]int64{},
+		}
+		learned.suffixes[suffixName] = stats
+	}
+
+	return stats
+}
+
+func (learned *Learned) prune(now time.Time) {
+	for name, session := range learned.sessions {
+		if now.Sub(session.started) > learned.window {
+			delete(learned.sessions, name)
+		}
+	}
+}
+
+func (learned *Learned) Observe(name string, qType uint16) {
+	now := time.Now()
+	name = strings.ToLower(name)
+
+	learned.mutex.Lock()
+	defer learned.mutex.Unlock()
+
+	stats := learned.stats(suffix(name))
+	if stats == nil {
+		return
+	}
+
+	current := learned.sessions[name]
+
+	if current != nil && now.Sub(current.started) <= learned.window {
+		if !current.seen[qType] {
+			current.seen[qType] = true
+			follows := stats.follows[current.first]
+			if follows == nil {
+				follows = map[uint16]int64{}
+				stats.follows[current.first] = follows
+			}
+			follows[qType]++
+		}
+		return
+	}
+
+	if len(learned.sessions) >= maxSessions {
+		learned.prune(now)
+	}
+
+	learned.sessions[name] = &session{
+		first:   qType,
+		started: now,
+		seen:    map[uint16]bool{qType: true},
+	}
+	stats.triggers[qType]++
+}
+
+func (learned *Learned) Tangents(name string, qType uint16) []uint16 {
+	learned.mutex.Lock()
+	defer learned.mutex.Unlock()
+
+	stats := learned.suffixes[suffix(name)]
+	if stats == nil || stats.triggers[qType] < learned.minSamples {
+		return nil
+	}
+
+	triggers := float64(stats.triggers[qType])
+	types := make([]uint16, 4)[:0]
+	for typ, count := range stats.follows[qType] {
+		if float64(count)/triggers >= learned.threshold {
+			types = append(types, typ)
+		}
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}
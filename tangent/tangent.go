@@ -0,0 +1,60 @@
+package tangent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Policy decides which record types are prefetched alongside a client query
+type Policy interface {
+	Observe(name string, qType uint16)
+	Tangents(name string, qType uint16) []uint16
+}
+
+func MakePolicy(mode string, typeNames []string, window time.Duration, threshold float64, minSamples int64) (Policy, error) {
+	switch mode {
+	case "", "off":
+		return Off{}, nil
+	case "static":
+		types := make([]uint16, len(typeNames))[:0]
+		for _, name := range typeNames {
+			typ, ok := dns.StringToType[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown tangent record type %s", name)
+			}
+			types = append(types, typ)
+		}
+		return Static{types}, nil
+	case "learned":
+		return MakeLearned(window, threshold, minSamples), nil
+	}
+
+	return nil, fmt.Errorf("unknown tangent policy %s", mode)
+}
+
+type Off struct{}
+
+func (Off) Observe(string, uint16) {}
+
+func (Off) Tangents(string, uint16) []uint16 {
+	return nil
+}
+
+type Static struct {
+	types []uint16
+}
+
+func (static Static) Observe(string, uint16) {}
+
+func (static Static) Tangents(_ string, qType uint16) []uint16 {
+	types := make([]uint16, len(static.types))[:0]
+	for _, typ := range static.types {
+		if typ != qType {
+			types = append(types, typ)
+		}
+	}
+
+	return types
+}
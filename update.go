@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Bob620/baka-dns/authority"
+	"github.com/Bob620/baka-dns/config"
+	"github.com/miekg/dns"
+)
+
+// Seconds of clock skew allowed on signed responses
+const tsigFudge = 300
+
+type updateKey struct {
+	algorithm string
+	secret    string
+	// Origins of the zones the key may update
+	zones map[string]bool
+}
+
+// Updater applies dynamic updates (RFC 2136) signed with a known TSIG key to the local zones, and flushes the changed
+// names from the caches
+type Updater struct {
+	zones       *authority.Zones
+	keys        map[string]updateKey
+	invalidator *Invalidator
+}
+
+func MakeUpdater(zones *authority.Zones, keys []config.TsigKey, invalidator *Invalidator) *Updater {
+	updater := &Updater{zones: zones, keys: map[string]updateKey{}, invalidator: invalidator}
+
+	for _, key := range keys {
+		algorithm := key.Algorithm
+		if algorithm == "" {
+			algorithm = dns.HmacSHA256
+		}
+
+		allowed := map[string]bool{}
+		for _, zone := range key.Zones {
+			allowed[strings.ToLower(dns.Fqdn(zone))] = true
+		}
+
+		updater.keys[strings.ToLower(dns.Fqdn(key.Name))] = updateKey{strings.ToLower(dns.Fqdn(algorithm)), key.Secret, allowed}
+	}
+
+	return updater
+}
+
+// Secrets by key name for the server to check signatures with
+func (updater *Updater) Secrets() map[string]string {
+	secrets := make(map[string]string, len(updater.keys))
+	for name, key := range updater.keys {
+		secrets[name] = key.secret
+	}
+
+	return secrets
+}
+
+// Let updates through to the handler with any number of records, everything else is checked as usual
+func acceptUpdates(header dns.Header) dns.MsgAcceptAction {
+	opcode := int(header.Bits>>11) & 0xF
+	if opcode != dns.OpcodeUpdate || header.Bits&(1<<15) != 0 {
+		return dns.DefaultMsgAcceptFunc(header)
+	}
+
+	if header.Qdcount != 1 {
+		return dns.MsgReject
+	}
+
+	return dns.MsgAccept
+}
+
+// Authorize and apply an update, returning the response and the names it changed. Updates have to be signed by a key
+// that may update the zone, and responses to correctly signed updates are signed too.
+func (updater *Updater) Update(msg *dns.Msg, tsigStatus error) (*dns.Msg, []string) {
+	res := &dns.Msg{}
+	res.SetReply(msg)
+
+	signature := msg.IsTsig()
+	if signature == nil {
+		res.Rcode = dns.RcodeRefused
+		return res, nil
+	}
+
+	key, known := updater.keys[strings.ToLower(signature.Hdr.Name)]
+	if tsigStatus != nil || !known || strings.ToLower(signature.Algorithm) != key.algorithm {
+		go fmt.Printf("Rejected update signed by %s: %v\n", signature.Hdr.Name, tsigStatus)
+		res.Rcode = dns.RcodeNotAuth
+		return res, nil
+	}
+	res.SetTsig(signature.Hdr.Name, signature.Algorithm, tsigFudge, time.Now().Unix())
+
+	if len(msg.Question) != 1 || msg.Question[0].Qtype != dns.TypeSOA {
+		res.Rcode = dns.RcodeFormatError
+		return res, nil
+	}
+
+	zone := msg.Question[0]
+	if zone.Qclass != dns.ClassINET {
+		res.Rcode = dns.RcodeNotAuth
+		return res, nil
+	}
+
+	origin := strings.ToLower(dns.Fqdn(zone.Name))
+	if !key.zones[origin] {
+		go fmt.Printf("Refused update to %s signed by %s\n", origin, signature.Hdr.Name)
+		res.Rcode = dns.RcodeRefused
+		return res, nil
+	}
+
+	rcode, changed := updater.zones.Update(origin, msg.Answer, msg.Ns, signature.Hdr.Name)
+	res.Rcode = rcode
+	go fmt.Printf("Update to %s signed by %s: %s, %d names changed\n", origin, signature.Hdr.Name, dns.RcodeToString[rcode], len(changed))
+
+	return res, changed
+}
+
+// Flush the names an update changed from the caches, in the background so responses don't wait on scanning redis
+func (updater *Updater) Flush(changed []string) {
+	if len(changed) > 0 {
+		go updater.invalidator.FlushNames(changed)
+	}
+}
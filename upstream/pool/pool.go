@@ -1,14 +1,75 @@
 package pool
 
 import (
+	"errors"
+	"fmt"
 	"github.com/miekg/dns"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Priority classes, interactive queries come from clients while prefetch queries are speculative
+type Priority int
+
+const (
+	Interactive Priority = iota
+	Prefetch
+)
+
+var ErrDropped = errors.New("prefetch queue is full, query dropped")
+
 type Message struct {
-	Name string
-	Type uint16
+	Name     string
+	Type     uint16
+	Class    uint16
+	Priority Priority
+	// Flags and client subnet (in CIDR form) passed on to upstreams, queries only share a resolver when they match
+	DnssecOk         bool
+	CheckingDisabled bool
+	Subnet           string
+}
+
+// Queries only share a resolver with queries of the same priority, a client query joining a prefetch would wait behind
+// the whole prefetch queue
+func (message Message) listingKey(priority Priority) string {
+	return fmt.Sprintf("%s/%d/%t/%t/%s/%d", message.Name, message.Class, message.DnssecOk, message.CheckingDisabled, message.Subnet, priority)
+}
+
+func (message Message) msg() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Compress = true
+	msg.RecursionDesired = true
+	msg.AuthenticatedData = true
+	msg.CheckingDisabled = message.CheckingDisabled
+
+	msg.SetQuestion(message.Name, message.Type)
+	if message.Class != 0 {
+		msg.Question[0].Qclass = message.Class
+	}
+
+	if message.DnssecOk || message.Subnet != "" {
+		msg.SetEdns0(4096, message.DnssecOk)
+	}
+
+	if _, subnet, err := net.ParseCIDR(message.Subnet); err == nil {
+		prefix, _ := subnet.Mask.Size()
+		option := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(prefix),
+			Address:       subnet.IP,
+		}
+		if subnet.IP.To4() == nil {
+			option.Family = 2
+		}
+
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, option)
+	}
+
+	return msg
 }
 
 type MessageResult struct {
@@ -23,12 +84,15 @@ type Query struct {
 }
 
 type Pool struct {
-	knownServers      []Server
-	serverOrder       []Server
-	resolvers         *DomainListing
-	messagesToResolve chan Query
-	wg                *sync.WaitGroup
-	dnsClientTimeout  time.Duration
+	// Every known server in the order they were added, and the active ones by priority, both under the servers lock
+	upstreams          []*upstream
+	serverOrder        []*upstream
+	servers            *sync.RWMutex
+	resolvers          *DomainListing
+	interactiveQueries chan Query
+	prefetchQueries    chan Query
+	wg                 *sync.WaitGroup
+	dnsClientTimeout   time.Duration
 }
 
 type ServerSuccess struct {
@@ -37,34 +101,80 @@ type ServerSuccess struct {
 }
 
 type ServerIter struct {
-	Server *Server
-	Index  int
+	Server   *Server
+	Index    int
+	upstream *upstream
 }
 
-func MakePool(knownServers *[]Server, serverOrder *[]Server, wg *sync.WaitGroup, timeout time.Duration) *Pool {
-	return &Pool{
-		*knownServers,
-		*serverOrder,
+// Servers in serverOrder start out active, the other known servers start out disabled. Only the known servers that are
+// disabled themselves stay disabled when the servers are saved.
+func MakePool(knownServers *[]Server, serverOrder *[]Server, wg *sync.WaitGroup, timeout time.Duration, prefetchQueue int) *Pool {
+	active := make(map[string]bool, len(*serverOrder))
+	for _, server := range *serverOrder {
+		active[server.Name] = !server.Disabled
+	}
+
+	upstreams := make([]*upstream, len(*knownServers))
+	for i, server := range *knownServers {
+		upstreams[i] = &upstream{server: server, state: Disabled, disabled: server.Disabled}
+		if active[server.Name] {
+			upstreams[i].state = Active
+		}
+		upstreams[i].server.Disabled = false
+	}
+
+	pool := &Pool{
+		upstreams,
+		nil,
+		&sync.RWMutex{},
 		&DomainListing{
 			map[string]*Domain{},
 			&sync.RWMutex{},
 		},
 		make(chan Query),
+		make(chan Query, prefetchQueue),
 		wg,
 		timeout,
 	}
+	pool.order()
+
+	return pool
 }
 
-func (pool Pool) Do(message Message) (*dns.Msg, *Server, error) {
+// Queue a query by priority, interactive queries wait for a worker while prefetch queries are dropped under load
+func (pool *Pool) enqueue(query Query, priority Priority) bool {
+	if priority == Interactive {
+		pool.interactiveQueries <- query
+		return true
+	}
+
+	select {
+	case pool.prefetchQueries <- query:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pool *Pool) Do(message Message) (*dns.Msg, *Server, error) {
 	resolveChan := make(chan *MessageResult)
 	var resolver *Resolver
 	var result *MessageResult
 
+	listingKey := message.listingKey(message.Priority)
+
 	pool.resolvers.mutex.RLock()
-	domainResolvers := pool.resolvers.domains[message.Name]
+	domainResolvers := pool.resolvers.domains[listingKey]
 	if domainResolvers != nil {
 		resolver = domainResolvers.Get(message.Type)
 	}
+
+	// Prefetches can still wait on a client query that is already being resolved
+	if resolver == nil && message.Priority != Interactive {
+		if interactive := pool.resolvers.domains[message.listingKey(Interactive)]; interactive != nil {
+			resolver = interactive.Get(message.Type)
+		}
+	}
 	pool.resolvers.mutex.RUnlock()
 
 	if resolver != nil {
@@ -72,45 +182,53 @@ func (pool Pool) Do(message Message) (*dns.Msg, *Server, error) {
 		result = <-resolveChan
 	} else {
 		if domainResolvers == nil {
-			domainResolvers = pool.resolvers.Add(message.Name)
+			domainResolvers = pool.resolvers.Add(listingKey)
 		}
 
 		resolver = domainResolvers.Add(message.Type, resolveChan)
 
-		msg := new(dns.Msg)
-		msg.Compress = true
-		msg.RecursionDesired = true
-		msg.AuthenticatedData = true
-
-		msg.SetQuestion(message.Name, message.Type)
-
-		pool.messagesToResolve <- Query{*msg, resolveChan}
+		if !pool.enqueue(Query{*message.msg(), resolver.resolver}, message.Priority) {
+			resolver.resolver <- &MessageResult{Error: ErrDropped}
+		}
 		result = <-resolveChan
 
 		empty := domainResolvers.Delete(message.Type)
 		if empty {
-			pool.resolvers.Delete(message.Name)
+			pool.resolvers.Delete(listingKey)
 		}
 	}
 
 	return result.Message, result.Server, result.Error
 }
 
+// Hand out the active servers one after another, moving on to the next server when one hasn't answered within half
+// the client timeout. Servers are taken from a snapshot so changes to the pool never affect a query being resolved.
 func (pool *Pool) ServerIter() (serverChan chan ServerIter, successChan chan ServerSuccess) {
-	serverChan = make(chan ServerIter)
+	pool.servers.RLock()
+	order := make([]*upstream, len(pool.serverOrder))
+	copy(order, pool.serverOrder)
+	pool.servers.RUnlock()
+
+	servers := make([]Server, len(order))
+	for i, upstream := range order {
+		servers[i] = upstream.server
+	}
+
+	// Sends after the worker has moved on must not block forever
+	serverChan = make(chan ServerIter, len(order)+1)
 	successChan = make(chan ServerSuccess)
-	results := make([]bool, pool.NumUpstreams())
+	results := make([]bool, len(order))
 
 	var iter func(int)
 	var outcomes func()
-	finished := false
+	var finished int32
 
 	outcomes = func() {
 		outcome := <-successChan
 
 		results[outcome.Index] = outcome.Succeeded
 		if outcome.Succeeded {
-			finished = true
+			atomic.StoreInt32(&finished, 1)
 		} else {
 			outcomes()
 		}
@@ -118,19 +236,24 @@ func (pool *Pool) ServerIter() (serverChan chan ServerIter, successChan chan Ser
 
 	iter = func(index int) {
 		time.AfterFunc(pool.dnsClientTimeout/2, func() {
-			if finished || index >= pool.NumUpstreams() {
-				serverChan <- ServerIter{nil, -1}
+			if atomic.LoadInt32(&finished) == 1 || index >= len(order) {
+				serverChan <- ServerIter{nil, -1, nil}
 				return
 			}
 
-			serverChan <- ServerIter{&pool.serverOrder[index], index}
+			serverChan <- ServerIter{&servers[index], index, order[index]}
 			go iter(index + 1)
 		})
 	}
 
+	if len(order) == 0 {
+		serverChan <- ServerIter{nil, -1, nil}
+		return
+	}
+
 	go outcomes()
 	go func() {
-		serverChan <- ServerIter{&pool.serverOrder[0], 0}
+		serverChan <- ServerIter{&servers[0], 0, order[0]}
 		iter(1)
 	}()
 	return
@@ -140,6 +263,10 @@ func (pool *Pool) GetClientTimeout() time.Duration {
 	return pool.dnsClientTimeout
 }
 
+// Number of active servers
 func (pool *Pool) NumUpstreams() int {
+	pool.servers.RLock()
+	defer pool.servers.RUnlock()
+
 	return len(pool.serverOrder)
 }
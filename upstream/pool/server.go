@@ -1,10 +1,12 @@
 package pool
 
 type Server struct {
-	Name     string
-	Address  string
-	Port     string
-	Priority uint
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Port     string `json:"port"`
+	Priority uint   `json:"priority"`
+	// Known but kept out of rotation until it is enabled
+	Disabled bool `json:"disabled,omitempty"`
 }
 
 type ByPriority []Server
@@ -0,0 +1,236 @@
+package pool
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+type ServerState string
+
+const (
+	Active ServerState = "active"
+	// Out of rotation, becomes disabled once its in-flight queries finish
+	Draining ServerState = "draining"
+	Disabled ServerState = "disabled"
+)
+
+var (
+	ErrUnknownServer = errors.New("no server with that name")
+	ErrServerExists  = errors.New("a server with that name already exists")
+	ErrBadServer     = errors.New("servers need a name, address and port")
+)
+
+type upstream struct {
+	server Server
+	// State and removal are guarded by the pool's servers lock
+	state    ServerState
+	removing bool
+	// Disabled through the config or the admin API rather than by failing the startup check or being drained, only
+	// this is saved to the config
+	disabled bool
+	inFlight int64
+	// Set while draining or removing so finished queries only take the lock when the server is on its way out
+	leaving int32
+}
+
+type ServerStatus struct {
+	Server
+	State    ServerState `json:"state"`
+	InFlight int64       `json:"in-flight"`
+	// Dropped from the pool as soon as its in-flight queries finish
+	Removing bool `json:"removing,omitempty"`
+}
+
+func (upstream *upstream) begin() {
+	atomic.AddInt64(&upstream.inFlight, 1)
+}
+
+// Rebuild the active servers by priority, servers with the same priority keep the order they were added in
+// Must be called with the servers lock held
+func (pool *Pool) order() {
+	order := make([]*upstream, len(pool.upstreams))[:0]
+	for _, upstream := range pool.upstreams {
+		if upstream.state == Active && !upstream.removing {
+			order = append(order, upstream)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].server.Priority < order[j].server.Priority
+	})
+	pool.serverOrder = order
+}
+
+// Must be called with the servers lock held
+func (pool *Pool) find(name string) (int, *upstream) {
+	for i, upstream := range pool.upstreams {
+		if upstream.server.Name == name {
+			return i, upstream
+		}
+	}
+
+	return -1, nil
+}
+
+// Finish draining or removing a server that has nothing in flight, must be called with the servers lock held
+func (pool *Pool) settle(upstream *upstream) {
+	if atomic.LoadInt64(&upstream.inFlight) > 0 {
+		return
+	}
+
+	if upstream.state == Draining {
+		upstream.state = Disabled
+	}
+	atomic.StoreInt32(&upstream.leaving, 0)
+
+	if upstream.removing {
+		if i, found := pool.find(upstream.server.Name); found == upstream {
+			pool.upstreams = append(pool.upstreams[:i], pool.upstreams[i+1:]...)
+		}
+	}
+}
+
+// A query sent to the server has finished
+func (pool *Pool) finish(upstream *upstream) {
+	if atomic.AddInt64(&upstream.inFlight, -1) > 0 || atomic.LoadInt32(&upstream.leaving) == 0 {
+		return
+	}
+
+	pool.servers.Lock()
+	pool.settle(upstream)
+	pool.servers.Unlock()
+}
+
+// Every known server with its state and the number of queries it is answering
+func (pool *Pool) Servers() []ServerStatus {
+	pool.servers.RLock()
+	defer pool.servers.RUnlock()
+
+	statuses := make([]ServerStatus, len(pool.upstreams))
+	for i, upstream := range pool.upstreams {
+		statuses[i] = ServerStatus{
+			Server:   upstream.server,
+			State:    upstream.state,
+			InFlight: atomic.LoadInt64(&upstream.inFlight),
+			Removing: upstream.removing,
+		}
+		statuses[i].Disabled = upstream.disabled
+	}
+
+	return statuses
+}
+
+// Servers as they should be saved to the config, only servers that were disabled are saved disabled so servers that
+// were down at startup or drained are checked again on the next start
+func (pool *Pool) KnownServers() []Server {
+	pool.servers.RLock()
+	defer pool.servers.RUnlock()
+
+	servers := make([]Server, len(pool.upstreams))[:0]
+	for _, upstream := range pool.upstreams {
+		if upstream.removing {
+			continue
+		}
+
+		server := upstream.server
+		server.Disabled = upstream.disabled
+		servers = append(servers, server)
+	}
+
+	return servers
+}
+
+// Add a server, it goes into rotation straight away unless it is disabled
+func (pool *Pool) AddServer(server Server) error {
+	if server.Name == "" || server.Address == "" || server.Port == "" {
+		return ErrBadServer
+	}
+
+	pool.servers.Lock()
+	defer pool.servers.Unlock()
+
+	if _, found := pool.find(server.Name); found != nil {
+		return ErrServerExists
+	}
+
+	added := &upstream{server: server, state: Active, disabled: server.Disabled}
+	if server.Disabled {
+		added.state = Disabled
+	}
+	added.server.Disabled = false
+
+	pool.upstreams = append(pool.upstreams, added)
+	pool.order()
+	return nil
+}
+
+// Take a server out of rotation and drop it once the queries it is answering finish
+func (pool *Pool) RemoveServer(name string) error {
+	pool.servers.Lock()
+	defer pool.servers.Unlock()
+
+	_, upstream := pool.find(name)
+	if upstream == nil || upstream.removing {
+		return ErrUnknownServer
+	}
+
+	upstream.removing = true
+	atomic.StoreInt32(&upstream.leaving, 1)
+	pool.order()
+	pool.settle(upstream)
+	return nil
+}
+
+// Take a server out of rotation, it is disabled once the queries it is answering finish
+func (pool *Pool) DrainServer(name string) error {
+	return pool.setState(name, Draining)
+}
+
+// Take a server out of rotation straight away, queries it is answering still finish
+func (pool *Pool) DisableServer(name string) error {
+	return pool.setState(name, Disabled)
+}
+
+func (pool *Pool) EnableServer(name string) error {
+	return pool.setState(name, Active)
+}
+
+func (pool *Pool) setState(name string, state ServerState) error {
+	pool.servers.Lock()
+	defer pool.servers.Unlock()
+
+	_, upstream := pool.find(name)
+	if upstream == nil || upstream.removing {
+		return ErrUnknownServer
+	}
+
+	// A disabled server has nothing left to drain
+	if state == Draining && upstream.state == Disabled {
+		return nil
+	}
+
+	upstream.state = state
+	if state == Draining {
+		atomic.StoreInt32(&upstream.leaving, 1)
+	} else {
+		upstream.disabled = state == Disabled
+	}
+	pool.order()
+	pool.settle(upstream)
+	return nil
+}
+
+func (pool *Pool) SetPriority(name string, priority uint) error {
+	pool.servers.Lock()
+	defer pool.servers.Unlock()
+
+	_, upstream := pool.find(name)
+	if upstream == nil || upstream.removing {
+		return ErrUnknownServer
+	}
+
+	upstream.server.Priority = priority
+	pool.order()
+	return nil
+}
@@ -5,13 +5,33 @@ import (
 	"net"
 )
 
-func Worker(pool *Pool) {
+// Wait for the next query, prefetch workers take interactive queries first when any are waiting
+func (pool *Pool) next(priority Priority) Query {
+	if priority == Interactive {
+		return <-pool.interactiveQueries
+	}
+
+	select {
+	case query := <-pool.interactiveQueries:
+		return query
+	default:
+	}
+
+	select {
+	case query := <-pool.interactiveQueries:
+		return query
+	case query := <-pool.prefetchQueries:
+		return query
+	}
+}
+
+func Worker(pool *Pool, priority Priority) {
 	defer pool.wg.Done()
 	dnsClient := new(dns.Client)
 	dnsClient.Timeout = pool.GetClientTimeout()
 
 	for {
-		query := <-pool.messagesToResolve
+		query := pool.next(priority)
 		var err error
 		var dnsRes *dns.Msg
 
@@ -23,7 +43,10 @@ func Worker(pool *Pool) {
 				break
 			}
 
+			serverIter.upstream.begin()
 			dnsRes, _, err = dnsClient.Exchange(&query.Message, net.JoinHostPort(serverIter.Server.Address, serverIter.Server.Port))
+			pool.finish(serverIter.upstream)
+
 			if err == nil {
 				// If we get a response we can return
 				query.ResolveChan <- &MessageResult{Message: dnsRes, Server: serverIter.Server}
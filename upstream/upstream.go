@@ -10,7 +10,7 @@ import (
 	"time"
 )
 
-func MakeUpstreamPool(size int, knownServers *[]pool.Server) *pool.Pool {
+func MakeUpstreamPool(size, prefetchSize, prefetchQueue int, knownServers *[]pool.Server) *pool.Pool {
 	// Check for well-known DNS resolvers to know which ones work on the current host
 	// Common issue for CSE-Lab machines is blocking UDP to 1.1.1.1
 	serverCheckChan := make(chan pool.Server)
@@ -18,6 +18,12 @@ func MakeUpstreamPool(size int, knownServers *[]pool.Server) *pool.Pool {
 	// Spawn goroutines for all the known resolvers
 	for _, server := range *knownServers {
 		go func(server pool.Server, returnChan chan<- pool.Server) {
+			// Disabled servers stay out of rotation until they are enabled
+			if server.Disabled {
+				returnChan <- pool.Server{}
+				return
+			}
+
 			dnsClient := new(dns.Client)
 			dnsClient.Timeout = 500 * time.Millisecond
 
@@ -54,12 +60,15 @@ func MakeUpstreamPool(size int, knownServers *[]pool.Server) *pool.Pool {
 	sort.Sort(pool.ByPriority(serverOrder))
 
 	var wg sync.WaitGroup
-	dnsPool := pool.MakePool(knownServers, &serverOrder, &wg, 500*time.Millisecond)
+	dnsPool := pool.MakePool(knownServers, &serverOrder, &wg, 500*time.Millisecond, prefetchQueue)
 
-	// Set up upstream dns clients
-	wg.Add(size)
+	// Set up upstream dns clients, each priority gets its own set of workers
+	wg.Add(size + prefetchSize)
 	for i := 0; i < size; i++ {
-		go pool.Worker(dnsPool)
+		go pool.Worker(dnsPool, pool.Interactive)
+	}
+	for i := 0; i < prefetchSize; i++ {
+		go pool.Worker(dnsPool, pool.Prefetch)
 	}
 
 	return dnsPool